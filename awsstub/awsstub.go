@@ -6,6 +6,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/ses"
 	"github.com/aws/aws-sdk-go/service/sns"
@@ -14,10 +15,15 @@ import (
 var (
 	S3GetObj            func(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
 	S3GetObjWithContext func(aws.Context, *s3.GetObjectInput, ...request.Option) (*s3.GetObjectOutput, error)
+	S3ListObjsV2Pages   func(*s3.ListObjectsV2Input, func(*s3.ListObjectsV2Output, bool) bool) error
 
 	SnsPublish func(*sns.PublishInput) (*sns.PublishOutput, error)
 
 	SendEmail func(*ses.SendEmailInput) (*ses.SendEmailOutput, error)
+
+	DynamoDBGetItem    func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	DynamoDBPutItem    func(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+	DynamoDBDeleteItem func(*dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error)
 )
 
 func InitAWS() {
@@ -29,10 +35,21 @@ func InitAWS() {
 	snsClient := sns.New(awsSession)
 	sesClient := ses.New(awsSession)
 
+	// DYNAMODB_ENDPOINT can be set to use DynamoDB Local
+	dynamoConf := aws.NewConfig()
+	if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+		dynamoConf = dynamoConf.WithEndpoint(endpoint)
+	}
+	dynamoClient := dynamodb.New(awsSession, dynamoConf)
+
 	S3GetObj = s3Client.GetObject
 	S3GetObjWithContext = s3Client.GetObjectWithContext
+	S3ListObjsV2Pages = s3Client.ListObjectsV2Pages
 	SnsPublish = snsClient.Publish
 
 	SendEmail = sesClient.SendEmail
 
+	DynamoDBGetItem = dynamoClient.GetItem
+	DynamoDBPutItem = dynamoClient.PutItem
+	DynamoDBDeleteItem = dynamoClient.DeleteItem
 }
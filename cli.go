@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+	"github.com/psanford/cloudtrail-tattletail/internal/statestore"
+)
+
+// runCommand runs a local CLI subcommand and returns the process exit code.
+func runCommand(args []string) int {
+	if len(args) < 1 {
+		usage()
+		return 2
+	}
+
+	switch args[0] {
+	case "test":
+		return testCommand(args[1:])
+	case "validate":
+		return validateCommand(args[1:])
+	case "test-rules":
+		return testRulesCommand(args[1:])
+	case "replay":
+		return replayCommand(args[1:])
+	}
+
+	usage()
+	return 2
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: %s <command> [args]
+
+When run without a command cloudtrail-tattletail starts as a lambda function.
+
+commands:
+  test         run rules against local CloudTrail files
+  validate     check a config file for errors
+  test-rules   run the test fixtures defined in a config file
+  replay       run rules against historical CloudTrail logs in S3
+`, os.Args[0])
+}
+
+func testCommand(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	confPath := flags.String("config", "tattletail.toml", "Path to config file")
+	verbose := flags.Bool("v", false, "Verbose logging")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s test [-config tattletail.toml] <cloudtrail_file>...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Files may be CloudTrail log files (.json or .json.gz) or streams of records (JSONL).\n")
+		fmt.Fprintf(os.Stderr, "Matches are printed to stdout; no alerts are sent.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	lgr := cliLogger(*verbose)
+
+	s := newServer()
+	err := s.loadLocalConfig(lgr, *confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load config err: %s\n", err)
+		return 1
+	}
+
+	printer := &dryRunDest{w: os.Stdout}
+	s.replaceDestinations(printer)
+
+	// keep output in the same order as the input
+	s.ruleWorkers = 1
+	s.deliveryWorkers = 1
+
+	var failed bool
+	for _, fname := range flags.Args() {
+		err := s.processLocalFile(lgr, fname)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", fname, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// cliLogger configures the root logger for local commands and
+// returns a new logger.
+func cliLogger(verbose bool) log15.Logger {
+	handler := log15.StreamHandler(os.Stderr, log15.LogfmtFormat())
+	if !verbose {
+		handler = log15.LvlFilterHandler(log15.LvlWarn, handler)
+	}
+	log15.Root().SetHandler(handler)
+	return log15.New()
+}
+
+func (s *server) loadLocalConfig(lgr log15.Logger, fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = s.loadConfigFrom(lgr.New("conf_src", "local", "filename", fname), f)
+	if err != nil {
+		return err
+	}
+
+	// local runs should never read or modify shared state, but
+	// may use a local state file to carry state across runs
+	if _, ok := s.state.(*statestore.File); !ok {
+		s.state = statestore.NewMemory()
+	}
+
+	return nil
+}
+
+// replaceDestinations replaces every rule's destinations with d.
+func (s *server) replaceDestinations(d destination.Destination) {
+	for i := range s.rules {
+		s.rules[i].dests = []destination.Destination{d}
+	}
+}
+
+// processLocalFile evaluates every record in a local file, which may
+// optionally be gzipped.
+func (s *server) processLocalFile(lgr log15.Logger, fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lgr = lgr.New("cloudtrail_file", fname)
+
+	r, err := maybeGunzip(f)
+	if err != nil {
+		return err
+	}
+
+	b := s.newBatch(lgr)
+	_, err = streamRecords(r, b.add)
+	if err != nil {
+		b.wait()
+		return err
+	}
+	b.complete()
+
+	return nil
+}
+
+// maybeGunzip returns a reader that decompresses r if it is gzipped.
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// dryRunDest is a destination that prints matches instead of
+// sending them anywhere.
+type dryRunDest struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (d *dryRunDest) ID() string {
+	return "dry-run"
+}
+
+func (d *dryRunDest) Type() string {
+	return "dry_run"
+}
+
+func (d *dryRunDest) Send(name, desc string, rec map[string]interface{}, matchObj interface{}) error {
+	return d.SendMatch(name, rec, matchObj, matchObj)
+}
+
+// SendMatch prints the rule name, eventID and match object. The payload
+// is printed as well if it differs from the match object (i.e. the rule
+// has a jq_transform).
+func (d *dryRunDest) SendMatch(name string, rec map[string]interface{}, matchObj, payload interface{}) error {
+	evtID, _ := rec["eventID"].(string)
+
+	matchTxt, err := json.Marshal(matchObj)
+	if err != nil {
+		return fmt.Errorf("marshal match obj err: %w", err)
+	}
+
+	line := fmt.Sprintf("rule=%q event_id=%q match=%s", name, evtID, matchTxt)
+	if !reflect.DeepEqual(matchObj, payload) {
+		payloadTxt, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("marshal payload err: %w", err)
+		}
+		line += fmt.Sprintf(" payload=%s", payloadTxt)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err = fmt.Fprintln(d.w, line)
+	return err
+}
@@ -6,30 +6,44 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/inconshreveable/log15"
 	"github.com/itchyny/gojq"
 	"github.com/psanford/cloudtrail-tattletail/awsstub"
 	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/destdiscord"
 	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+	"github.com/psanford/cloudtrail-tattletail/internal/destmattermost"
+	"github.com/psanford/cloudtrail-tattletail/internal/destmsteams"
+	"github.com/psanford/cloudtrail-tattletail/internal/destopsgenie"
+	"github.com/psanford/cloudtrail-tattletail/internal/destpagerduty"
 	"github.com/psanford/cloudtrail-tattletail/internal/destses"
 	"github.com/psanford/cloudtrail-tattletail/internal/destslack"
 	"github.com/psanford/cloudtrail-tattletail/internal/destsns"
+	"github.com/psanford/cloudtrail-tattletail/internal/destwebhook"
+	"github.com/psanford/cloudtrail-tattletail/internal/statestore"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	awsstub.InitAWS()
 	handler := log15.StreamHandler(os.Stdout, log15.LogfmtFormat())
 	log15.Root().SetHandler(handler)
 	s := newServer()
+	s.inLambda = true
 	lambda.Start(s.Handler)
 }
 
@@ -38,6 +52,12 @@ func newServer() *server {
 		destsns.NewLoader(),
 		destses.NewLoader(),
 		destslack.NewLoader(),
+		destwebhook.NewLoader(),
+		destpagerduty.NewLoader(),
+		destopsgenie.NewLoader(),
+		destmsteams.NewLoader(),
+		destdiscord.NewLoader(),
+		destmattermost.NewLoader(),
 	}
 
 	s := server{
@@ -52,17 +72,40 @@ func newServer() *server {
 type server struct {
 	loaders map[string]destination.Loader
 
-	rules []Rule
+	rules           []Rule
+	suppressions    []suppression
+	destinations    map[string]destination.Destination
+	state           statestore.Store
+	stateConf       config.StateStore
+	ruleWorkers     int
+	deliveryWorkers int
+
+	// inLambda is set when running as a lambda function rather than
+	// one of the local commands.
+	inLambda bool
+
+	// confSrc identifies where the currently loaded config came from.
+	// It is empty if no config has been loaded.
+	confSrc      string
+	confETag     string
+	confLoadedAt time.Time
 }
 
-func (s *server) Handler(evt events.S3Event) error {
+// Handler is the lambda entrypoint. It accepts any of the supported
+// trigger event types and returns the appropriate response for that
+// type (if any).
+func (s *server) Handler(ctx context.Context, payload json.RawMessage) (interface{}, error) {
 	lgr := log15.New()
 
 	err := s.loadConfig(lgr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	return s.handleEvent(lgr, payload)
+}
+
+func (s *server) handleS3Event(lgr log15.Logger, evt events.S3Event) error {
 	for _, rec := range evt.Records {
 		err := s.handleRecord(lgr, rec)
 		if err != nil {
@@ -78,15 +121,54 @@ func (s *server) loadConfig(lgr log15.Logger) error {
 	bucketName := os.Getenv("S3_CONFIG_BUCKET")
 	confPath := os.Getenv("S3_CONFIG_PATH")
 
-	var confReader io.Reader
+	// if CONFIG_CACHE_TTL is set, a cached s3 config is used without
+	// revalidation until the ttl expires
+	var cacheTTL time.Duration
+	if ttl := os.Getenv("CONFIG_CACHE_TTL"); ttl != "" {
+		var err error
+		cacheTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			lgr.Error("invalid_config_cache_ttl", "err", err, "ttl", ttl)
+			return fmt.Errorf("invalid CONFIG_CACHE_TTL %q: %w", ttl, err)
+		}
+	}
+
+	var (
+		confReader io.Reader
+		confSrc    string
+		etag       string
+	)
 
 	if bucketName != "" && confPath != "" {
 		lgr = lgr.New("conf_src", "s3", "bucket", bucketName, "path", confPath)
-		confResp, err := awsstub.S3GetObj(&s3.GetObjectInput{
+		confSrc = "s3://" + bucketName + "/" + confPath
+
+		cached := s.confSrc == confSrc
+		if cached && cacheTTL > 0 && time.Since(s.confLoadedAt) < cacheTTL {
+			return nil
+		}
+
+		getInput := s3.GetObjectInput{
 			Bucket: aws.String(bucketName),
 			Key:    aws.String(confPath),
-		})
+		}
+		if cached && s.confETag != "" {
+			getInput.IfNoneMatch = aws.String(s.confETag)
+		}
 
+		confResp, err := awsstub.S3GetObj(&getInput)
+		if reqErr, ok := err.(awserr.RequestFailure); ok && cached && reqErr.StatusCode() == http.StatusNotModified {
+			lgr.Debug("config_not_modified", "etag", s.confETag)
+			s.confLoadedAt = time.Now()
+			return nil
+		}
+
+		if err != nil && cached {
+			// keep using the cached config rather than failing the
+			// invocation over a transient error (throttling, network)
+			lgr.Warn("revalidate_config_err_using_cached", "err", err, "etag", s.confETag)
+			return nil
+		}
 		if err != nil {
 			lgr.Error("load_config_from_s3_err", "err", err)
 			return err
@@ -94,8 +176,16 @@ func (s *server) loadConfig(lgr log15.Logger) error {
 		defer confResp.Body.Close()
 
 		confReader = confResp.Body
+		etag = aws.StringValue(confResp.ETag)
 	} else {
 		fname := "tattletail.toml"
+		confSrc = "file://" + fname
+		if s.confSrc == confSrc {
+			// the bundled config can't change during the lifetime
+			// of the lambda function
+			return nil
+		}
+
 		lgr = lgr.New("conf_src", "local_bundle", "filename", fname)
 		f, err := os.Open(fname)
 		if err != nil {
@@ -106,8 +196,24 @@ func (s *server) loadConfig(lgr log15.Logger) error {
 		confReader = f
 	}
 
+	err := s.loadConfigFrom(lgr, confReader)
+	if err != nil {
+		s.confSrc = ""
+		return err
+	}
+
+	s.confSrc = confSrc
+	s.confETag = etag
+	s.confLoadedAt = time.Now()
+
+	return nil
+}
+
+// loadConfigFrom parses and compiles the config read from r. The server's
+// rules and settings are only replaced if the whole config is valid.
+func (s *server) loadConfigFrom(lgr log15.Logger, r io.Reader) error {
 	var conf config.Config
-	_, err := toml.DecodeReader(confReader, &conf)
+	_, err := toml.DecodeReader(r, &conf)
 	if err != nil {
 		lgr.Error("config_toml_parse_err", "err", err)
 		return err
@@ -136,22 +242,155 @@ func (s *server) loadConfig(lgr log15.Logger) error {
 		destinations[d.ID()] = d
 	}
 
-	s.rules = make([]Rule, 0, len(conf.Rules))
+	// keep the existing state store (and the state in it) unless
+	// its config has changed
+	state := s.state
+	if state == nil || conf.StateStore != s.stateConf {
+		state, err = statestore.New(conf.StateStore)
+		if err != nil {
+			lgr.Error("invalid_state_store_config", "err", err)
+			return err
+		}
+	}
+
+	var dedupTTL time.Duration
+	if conf.DedupTTL != "" {
+		dedupTTL, err = parseDuration(conf.DedupTTL)
+		if err != nil {
+			lgr.Error("invalid_dedup_ttl", "err", err)
+			return fmt.Errorf("invalid dedup_ttl: %w", err)
+		}
+	}
+
+	suppressions := make([]suppression, 0, len(conf.Suppressions))
+	for i, cs := range conf.Suppressions {
+		name := cs.Name
+		if name == "" {
+			name = fmt.Sprintf("suppress_%d", i)
+		}
+		e, err := newException(cs.Exception)
+		if err != nil {
+			lgr.Error("invalid_suppression", "err", err, "name", name, "idx", i)
+			return fmt.Errorf("invalid suppression name=%q idx=%d: %w", name, i, err)
+		}
+		if e.expired(time.Now()) {
+			lgr.Warn("suppression_expired", "name", name, "reason", e.reason, "expires", cs.Expires)
+		}
+		suppressions = append(suppressions, suppression{name: name, exception: e})
+	}
+
+	rules := make([]Rule, 0, len(conf.Rules))
+	nameCount := ruleNameCount(conf.Rules)
 
 	for i, rule := range conf.Rules {
 		r := Rule{
-			name: rule.Name,
-			desc: rule.Desc,
+			name:      rule.Name,
+			desc:      rule.Desc,
+			severity:  rule.Severity,
+			matchMode: rule.MatchMode,
 		}
-		if rule.JQMatch == "" {
+		if err := checkStateRuleName(conf, rule, nameCount); err != nil {
+			lgr.Error("invalid_rule_name", "err", err, "rule_name", rule.Name, "rule_idx", i)
+			return fmt.Errorf("invalid rule name=%q idx=%d: %w", rule.Name, i, err)
+		}
+		if s.inLambda {
+			if err := checkSharedState(conf, rule); err != nil {
+				lgr.Error("invalid_state_store_for_rule", "err", err, "rule_name", rule.Name, "rule_idx", i)
+				return fmt.Errorf("invalid rule name=%q idx=%d: %w", rule.Name, i, err)
+			}
+		}
+		if r.severity != "" && !destination.ValidSeverity(r.severity) {
+			lgr.Error("invalid_severity", "rule_name", rule.Name, "rule_idx", i, "severity", rule.Severity)
+			return fmt.Errorf("invalid severity %q for rule name=%q idx=%d", rule.Severity, rule.Name, i)
+		}
+		switch r.matchMode {
+		case "":
+			r.matchMode = matchFirst
+		case matchFirst, matchCollect, matchEach:
+		default:
+			lgr.Error("invalid_match_mode", "rule_name", rule.Name, "rule_idx", i, "match_mode", rule.MatchMode)
+			return fmt.Errorf("invalid match_mode %q for rule name=%q idx=%d", rule.MatchMode, rule.Name, i)
+		}
+		jqMatch := rule.JQMatch
+		if jqMatch == "" && rule.Type == ruleSequence {
+			// sequence rules match on their steps
+			jqMatch = "."
+		} else if jqMatch == "" {
 			lgr.Error("jq_match_not_defined_for_rule", "rule_name", rule.Name, "rule_idx", i)
 			return fmt.Errorf("jq_match not defined for rule name=%q idx=%d", rule.Name, i)
 		}
-		q, err := gojq.Parse(rule.JQMatch)
+		q, err := gojq.Parse(jqMatch)
+		if err != nil {
+			return fmt.Errorf("parse jq_match err for rule name=%q idx=%d query=%q err=%w", rule.Name, i, jqMatch, err)
+		}
+		r.query, err = gojq.Compile(q)
 		if err != nil {
-			return fmt.Errorf("parse jq_match err for rule name=%q idx=%d query=%q err=%w", rule.Name, i, rule.JQMatch, err)
+			return fmt.Errorf("compile jq_match err for rule name=%q idx=%d query=%q err=%w", rule.Name, i, jqMatch, err)
+		}
+
+		if rule.JQTransform != "" {
+			tq, err := gojq.Parse(rule.JQTransform)
+			if err != nil {
+				return fmt.Errorf("parse jq_transform err for rule name=%q idx=%d query=%q err=%w", rule.Name, i, rule.JQTransform, err)
+			}
+			code, err := gojq.Compile(tq, gojq.WithVariables([]string{"$match"}))
+			if err != nil {
+				return fmt.Errorf("compile jq_transform err for rule name=%q idx=%d query=%q err=%w", rule.Name, i, rule.JQTransform, err)
+			}
+			r.transform = code
+		}
+
+		r.dedupTTL = dedupTTL
+		if rule.DedupTTL != "" {
+			r.dedupTTL, err = parseDuration(rule.DedupTTL)
+			if err != nil {
+				return fmt.Errorf("invalid dedup_ttl for rule name=%q idx=%d: %w", rule.Name, i, err)
+			}
+		}
+
+		if rule.DedupKey != "" {
+			dq, err := gojq.Parse(rule.DedupKey)
+			if err != nil {
+				return fmt.Errorf("parse dedup_key err for rule name=%q idx=%d query=%q err=%w", rule.Name, i, rule.DedupKey, err)
+			}
+			r.dedupKey, err = gojq.Compile(dq, gojq.WithVariables([]string{"$match"}))
+			if err != nil {
+				return fmt.Errorf("compile dedup_key err for rule name=%q idx=%d query=%q err=%w", rule.Name, i, rule.DedupKey, err)
+			}
+		}
+
+		switch rule.Type {
+		case "", ruleMatch:
+		case ruleThreshold:
+			r.threshold, err = newThreshold(rule)
+			if err != nil {
+				return fmt.Errorf("invalid threshold rule name=%q idx=%d: %w", rule.Name, i, err)
+			}
+		case ruleFirstSeen:
+			r.firstSeen, err = newFirstSeen(rule)
+			if err != nil {
+				return fmt.Errorf("invalid first_seen rule name=%q idx=%d: %w", rule.Name, i, err)
+			}
+		case ruleSequence:
+			r.sequence, err = newSequence(rule)
+			if err != nil {
+				return fmt.Errorf("invalid sequence rule name=%q idx=%d: %w", rule.Name, i, err)
+			}
+		default:
+			lgr.Error("invalid_rule_type", "rule_name", rule.Name, "rule_idx", i, "type", rule.Type)
+			return fmt.Errorf("invalid type %q for rule name=%q idx=%d", rule.Type, rule.Name, i)
+		}
+
+		for j, ce := range rule.Exceptions {
+			e, err := newException(ce)
+			if err != nil {
+				return fmt.Errorf("invalid exception idx=%d for rule name=%q idx=%d: %w", j, rule.Name, i, err)
+			}
+			if e.expired(time.Now()) {
+				lgr.Warn("rule_exception_expired", "rule_name", rule.Name, "exception_idx", j, "reason", e.reason, "expires", ce.Expires)
+			}
+			r.exceptions = append(r.exceptions, e)
 		}
-		r.query = q
 
 		for _, destName := range rule.Destinations {
 			dest := destinations[destName]
@@ -161,10 +400,18 @@ func (s *server) loadConfig(lgr log15.Logger) error {
 			r.dests = append(r.dests, dest)
 		}
 
-		s.rules = append(s.rules, r)
+		rules = append(rules, r)
 		lgr.Info("loaded_rule", "name", r.name)
 	}
 
+	s.rules = rules
+	s.state = state
+	s.stateConf = conf.StateStore
+	s.suppressions = suppressions
+	s.destinations = destinations
+	s.ruleWorkers = conf.RuleWorkers
+	s.deliveryWorkers = conf.DeliveryWorkers
+
 	return nil
 }
 
@@ -196,66 +443,121 @@ func (s *server) handleRecord(lgr log15.Logger, s3rec events.S3EventRecord) erro
 		lgr.Error("new_gz_reader_err", "err", err)
 		return err
 	}
-	body, err := ioutil.ReadAll(r)
+
+	b := s.newBatch(lgr)
+	_, err = streamRecords(r, b.add)
 	if err != nil {
-		lgr.Error("read_body_err", "err", err)
+		b.wait()
+		lgr.Error("decode_json_err", "err", err, "record_count", b.recordCount, "match_count", b.matchCount)
 		return err
 	}
 
-	var doc struct {
-		Records []map[string]interface{} `json:"records"`
-	}
+	b.complete()
 
-	err = json.Unmarshal(body, &doc)
-	if err != nil {
-		lgr.Error("decode_json_err", "err", err)
-		return err
-	}
+	return nil
+}
 
-	var matchCount int
+const (
+	// matchFirst only considers the first output of jq_match.
+	matchFirst = "first"
+	// matchCollect gathers every matching output of jq_match into a
+	// single alert whose match object is an array.
+	matchCollect = "collect"
+	// matchEach sends a separate alert for every matching output of jq_match.
+	matchEach = "each"
+)
 
-	for _, rec := range doc.Records {
-		for _, rule := range s.rules {
-			var evtID string
-			idI, ok := rec["eventID"]
-			if ok {
-				evtID, _ = idI.(string)
-			}
-			if match, obj := rule.Match(lgr, rec); match {
-				matchCount++
-				lgr.Info("rule_matched", "rule_name", rule.name, "evt_id", evtID)
-				for _, dest := range rule.dests {
-					lgr.Info("publish_alert", "dest", dest, "rule_name", rule.name, "evt_id", evtID)
-					err = dest.Send(rule.name, rule.desc, rec, obj)
-					if err != nil {
-						lgr.Error("publish_alert_err", "err", err, "type", dest.Type(), "rule_name", rule.name, "evt_id", evtID)
-					}
-				}
-			}
+const (
+	// ruleMatch rules alert on every matching record.
+	ruleMatch = "match"
+	// ruleThreshold rules alert when the number of matching records
+	// in a group crosses a threshold within a time window.
+	ruleThreshold = "threshold"
+	// ruleFirstSeen rules alert the first time a value is seen.
+	ruleFirstSeen = "first_seen"
+	// ruleSequence rules alert when records matching each of a list
+	// of steps happen in order within a time window.
+	ruleSequence = "sequence"
+)
+
+type Rule struct {
+	name       string
+	desc       string
+	severity   string
+	matchMode  string
+	query      *gojq.Code
+	transform  *gojq.Code
+	exceptions []*exception
+	dedupKey   *gojq.Code
+	dedupTTL   time.Duration
+	dests      []destination.Destination
+
+	// threshold is set for rules with type "threshold"
+	threshold *threshold
+	// firstSeen is set for rules with type "first_seen"
+	firstSeen *firstSeen
+	// sequence is set for rules with type "sequence"
+	sequence *sequence
+}
+
+// Matches returns the match objects for rec, one per alert that should be
+// sent. An empty result means the rule did not match.
+//
+// In "first" mode this is the result of Match. In "collect" and "each" mode
+// every output of the query is considered: errors are logged and skipped,
+// null and false are ignored, and all other values (including true) are
+// matches. "collect" returns a single array of those values, "each" returns
+// them individually.
+func (r *Rule) Matches(lgr log15.Logger, rec map[string]interface{}) []interface{} {
+	if r.matchMode == "" || r.matchMode == matchFirst {
+		if match, obj := r.Match(lgr, rec); match {
+			return []interface{}{obj}
+		}
+		return nil
+	}
+
+	var matches []interface{}
+	iter := r.query.Run(rec)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			break
 		}
+		if err, ok := v.(error); ok {
+			lgr.Error("match_err", "err", err, "rule_name", r.name, "obj", rec)
+			continue
+		}
+		if v == nil || v == false {
+			continue
+		}
+		matches = append(matches, v)
 	}
 
-	lgr.Info("processing_complete", "record_count", len(doc.Records), "match_count", matchCount)
+	if len(matches) == 0 {
+		return nil
+	}
 
-	return nil
-}
+	if r.matchMode == matchCollect {
+		return []interface{}{matches}
+	}
 
-type Rule struct {
-	name      string
-	desc      string
-	query     *gojq.Query
-	transform *gojq.Query
-	dests     []destination.Destination
+	return matches
 }
 
 func (r *Rule) Match(lgr log15.Logger, rec map[string]interface{}) (bool, interface{}) {
-	iter := r.query.Run(rec)
+	return matchQuery(lgr, r.name, r.query, rec)
+}
+
+// matchQuery runs query against rec and reports whether its first output
+// is a match, along with the match object.
+func matchQuery(lgr log15.Logger, ruleName string, query *gojq.Code, rec map[string]interface{}) (bool, interface{}) {
+	iter := query.Run(rec)
 	v, ok := iter.Next()
 	if !ok {
 		return false, nil
 	}
 	if err, ok := v.(error); ok {
-		lgr.Error("match_err", "err", err, "rule_name", r.name, "obj", rec)
+		lgr.Error("match_err", "err", err, "rule_name", ruleName, "obj", rec)
 		return false, ""
 	}
 
@@ -270,3 +572,26 @@ func (r *Rule) Match(lgr log15.Logger, rec map[string]interface{}) (bool, interf
 
 	return true, v
 }
+
+// Transform runs the rule's jq_transform query (if any) against rec and
+// returns the payload that should be sent to the rule's destinations.
+// If the rule has no transform, or the transform fails or produces no
+// output, matchObj is returned unchanged.
+func (r *Rule) Transform(lgr log15.Logger, rec map[string]interface{}, matchObj interface{}) interface{} {
+	if r.transform == nil {
+		return matchObj
+	}
+
+	iter := r.transform.Run(rec, matchObj)
+	v, ok := iter.Next()
+	if !ok {
+		lgr.Warn("transform_no_output", "rule_name", r.name)
+		return matchObj
+	}
+	if err, ok := v.(error); ok {
+		lgr.Error("transform_err", "err", err, "rule_name", r.name, "obj", rec)
+		return matchObj
+	}
+
+	return v
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/md5"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,8 +14,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -23,11 +32,18 @@ import (
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/google/go-cmp/cmp"
 	"github.com/inconshreveable/log15"
+	"github.com/itchyny/gojq"
 	"github.com/psanford/cloudtrail-tattletail/awsstub"
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
 	"github.com/psanford/cloudtrail-tattletail/internal/destsns"
+	"github.com/psanford/cloudtrail-tattletail/internal/statestore"
 )
 
 var (
+	// fakeMu guards the fake aws state since alerts are
+	// delivered concurrently.
+	fakeMu      sync.Mutex
 	fakeS3      = make(map[bucketKey][]byte)
 	snsMessages []destsns.Payload
 	sentEmails  []sentEmail
@@ -78,7 +94,9 @@ func TestRuleMatchingForwarding(t *testing.T) {
 			http.Error(w, "Read err", 500)
 			return
 		}
+		fakeMu.Lock()
 		webhookPayloads = append(webhookPayloads, string(body))
+		fakeMu.Unlock()
 	})
 
 	fakeSlack := httptest.NewServer(handler)
@@ -150,7 +168,7 @@ from_email = "cloudtrail_tattletail@example.com"
 		sentEmails = sentEmails[:0]
 		webhookPayloads = webhookPayloads[:0]
 
-		err = server.Handler(evt)
+		_, err = server.Handler(context.Background(), mustMarshal(t, evt))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -225,11 +243,1835 @@ from_email = "cloudtrail_tattletail@example.com"
 	}
 }
 
+func TestRuleTransform(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	q, err := gojq.Parse(`select(.eventName == "CreateUser") | .responseElements.user.userName`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qc, err := gojq.Compile(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tq, err := gojq.Parse(`{user: $match, actor: .userIdentity.arn}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := gojq.Compile(tq, gojq.WithVariables([]string{"$match"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := Rule{
+		name:      "Create User",
+		query:     qc,
+		transform: code,
+	}
+
+	rec := map[string]interface{}{
+		"eventName": "CreateUser",
+		"userIdentity": map[string]interface{}{
+			"arn": "arn:aws:iam::123456789:user/admin",
+		},
+		"responseElements": map[string]interface{}{
+			"user": map[string]interface{}{
+				"userName": "user1",
+			},
+		},
+	}
+
+	lgr := log15.New()
+	match, obj := r.Match(lgr, rec)
+	if !match {
+		t.Fatal("expected rule to match")
+	}
+	if obj != "user1" {
+		t.Fatalf("expected match obj user1 but got %v", obj)
+	}
+
+	payload := r.Transform(lgr, rec, obj)
+	expect := map[string]interface{}{
+		"user":  "user1",
+		"actor": "arn:aws:iam::123456789:user/admin",
+	}
+	if !cmp.Equal(payload, expect) {
+		t.Fatal(cmp.Diff(payload, expect))
+	}
+
+	r.transform = nil
+	payload = r.Transform(lgr, rec, obj)
+	if payload != "user1" {
+		t.Fatalf("expected untransformed payload user1 but got %v", payload)
+	}
+}
+
+func TestRuleMatchModes(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	rec := map[string]interface{}{
+		"eventName": "AttachRolePolicy",
+		"requestParameters": map[string]interface{}{
+			"policyArns": []interface{}{"arn:a", "arn:b"},
+			"flags":      []interface{}{nil, false, true, "x"},
+		},
+	}
+
+	checks := []struct {
+		mode   string
+		query  string
+		expect []interface{}
+	}{
+		{
+			mode:   matchFirst,
+			query:  ".requestParameters.policyArns[]",
+			expect: []interface{}{"arn:a"},
+		},
+		{
+			mode:   matchCollect,
+			query:  ".requestParameters.policyArns[]",
+			expect: []interface{}{[]interface{}{"arn:a", "arn:b"}},
+		},
+		{
+			mode:   matchEach,
+			query:  ".requestParameters.policyArns[]",
+			expect: []interface{}{"arn:a", "arn:b"},
+		},
+		{
+			mode:   matchEach,
+			query:  ".requestParameters.flags[]",
+			expect: []interface{}{true, "x"},
+		},
+		{
+			mode:   matchCollect,
+			query:  ".requestParameters.flags[]",
+			expect: []interface{}{[]interface{}{true, "x"}},
+		},
+		{
+			mode:   matchFirst,
+			query:  ".requestParameters.flags[]",
+			expect: nil,
+		},
+		{
+			mode:   matchCollect,
+			query:  ".requestParameters.missing[]?",
+			expect: nil,
+		},
+	}
+
+	for _, check := range checks {
+		q, err := gojq.Parse(check.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := gojq.Compile(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := Rule{
+			name:      "policies",
+			matchMode: check.mode,
+			query:     code,
+		}
+
+		got := r.Matches(log15.New(), rec)
+		if !cmp.Equal(got, check.expect) {
+			t.Errorf("mode=%s query=%s: %s", check.mode, check.query, cmp.Diff(got, check.expect))
+		}
+	}
+}
+
+func TestSQSInput(t *testing.T) {
+	snsMessages = snsMessages[:0]
+	server := setupTestServer(t, testSNSConfig)
+
+	bucketName := "shipwreck-chrysanthemum"
+	putGzTestdata(t, bucketName, "good.json.gz", "testdata/1.json")
+
+	s3Evt := func(key string) string {
+		evt := events.S3Event{
+			Records: []events.S3EventRecord{
+				{
+					EventSource: "aws:s3",
+					S3: events.S3Entity{
+						Bucket: events.S3Bucket{Name: bucketName},
+						Object: events.S3Object{Key: key},
+					},
+				},
+			},
+		}
+		return string(mustMarshal(t, evt))
+	}
+
+	evt := events.SQSEvent{
+		Records: []events.SQSMessage{
+			{
+				MessageId:   "msg-good",
+				EventSource: "aws:sqs",
+				Body:        s3Evt("good.json.gz"),
+			},
+			{
+				MessageId:   "msg-missing",
+				EventSource: "aws:sqs",
+				Body:        s3Evt("missing.json.gz"),
+			},
+			{
+				MessageId:   "msg-test-event",
+				EventSource: "aws:sqs",
+				Body:        `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"shipwreck-chrysanthemum"}`,
+			},
+		},
+	}
+
+	resp, err := server.Handler(context.Background(), mustMarshal(t, evt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := events.SQSEventResponse{
+		BatchItemFailures: []events.SQSBatchItemFailure{
+			{ItemIdentifier: "msg-missing"},
+		},
+	}
+	if !cmp.Equal(resp, expect) {
+		t.Fatal(cmp.Diff(resp, expect))
+	}
+
+	if len(snsMessages) != 1 {
+		t.Fatalf("expected 1 sns message but got %d", len(snsMessages))
+	}
+}
+
+func TestSNSInput(t *testing.T) {
+	snsMessages = snsMessages[:0]
+	server := setupTestServer(t, testSNSConfig)
+
+	bucketName := "gallivanting-hemispheres"
+	putGzTestdata(t, bucketName, "s3-event.json.gz", "testdata/1.json")
+	putGzTestdata(t, bucketName, "cloudtrail-notification.json.gz", "testdata/1.json")
+
+	s3Evt := events.S3Event{
+		Records: []events.S3EventRecord{
+			{
+				EventSource: "aws:s3",
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{Name: bucketName},
+					Object: events.S3Object{Key: "s3-event.json.gz"},
+				},
+			},
+		},
+	}
+
+	ctNotification := fmt.Sprintf(`{"s3Bucket":%q,"s3ObjectKey":["cloudtrail-notification.json.gz"]}`, bucketName)
+
+	evt := events.SNSEvent{
+		Records: []events.SNSEventRecord{
+			{
+				EventSource: "aws:sns",
+				SNS: events.SNSEntity{
+					MessageID: "s3-event",
+					Message:   string(mustMarshal(t, s3Evt)),
+				},
+			},
+			{
+				EventSource: "aws:sns",
+				SNS: events.SNSEntity{
+					MessageID: "cloudtrail-notification",
+					Message:   ctNotification,
+				},
+			},
+		},
+	}
+
+	_, err := server.Handler(context.Background(), mustMarshal(t, evt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snsMessages) != 2 {
+		t.Fatalf("expected 2 sns messages but got %d", len(snsMessages))
+	}
+
+	// SNS envelope delivered through SQS
+	snsMessages = snsMessages[:0]
+	envelope := map[string]string{
+		"Type":    "Notification",
+		"Message": ctNotification,
+	}
+	sqsEvt := events.SQSEvent{
+		Records: []events.SQSMessage{
+			{
+				MessageId:   "sns-envelope",
+				EventSource: "aws:sqs",
+				Body:        string(mustMarshal(t, envelope)),
+			},
+		},
+	}
+
+	resp, err := server.Handler(context.Background(), mustMarshal(t, sqsEvt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.(events.SQSEventResponse).BatchItemFailures) != 0 {
+		t.Fatalf("unexpected batch item failures: %+v", resp)
+	}
+	if len(snsMessages) != 1 {
+		t.Fatalf("expected 1 sns message but got %d", len(snsMessages))
+	}
+}
+
+func TestEventBridgeInput(t *testing.T) {
+	snsMessages = snsMessages[:0]
+	server := setupTestServer(t, testSNSConfig)
+
+	jsonTxt, err := ioutil.ReadFile("testdata/1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Records []json.RawMessage `json:"records"`
+	}
+	err = json.Unmarshal(jsonTxt, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rec := range doc.Records {
+		evt := events.CloudWatchEvent{
+			Version:    "0",
+			ID:         "6f2c3a1e-0b5b-4e34-a0a1-42e0c1f2a9f0",
+			DetailType: "AWS API Call via CloudTrail",
+			Source:     "aws.iam",
+			Detail:     rec,
+		}
+
+		_, err = server.Handler(context.Background(), mustMarshal(t, evt))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(snsMessages) != 1 {
+		t.Fatalf("expected 1 sns message but got %d", len(snsMessages))
+	}
+	if snsMessages[0].Match != "username: user1" {
+		t.Fatalf("unexpected match: %v", snsMessages[0].Match)
+	}
+}
+
+func TestCloudwatchLogsInput(t *testing.T) {
+	snsMessages = snsMessages[:0]
+	server := setupTestServer(t, testSNSConfig)
+
+	data := cloudwatchLogsTestdata(t)
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evt := events.CloudwatchLogsEvent{
+		AWSLogs: events.CloudwatchLogsRawData{
+			Data: base64.StdEncoding.EncodeToString(buf.Bytes()),
+		},
+	}
+
+	_, err = server.Handler(context.Background(), mustMarshal(t, evt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snsMessages) != 1 {
+		t.Fatalf("expected 1 sns message but got %d", len(snsMessages))
+	}
+}
+
+func TestKinesisInput(t *testing.T) {
+	snsMessages = snsMessages[:0]
+	server := setupTestServer(t, testSNSConfig)
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	err := json.NewEncoder(w).Encode(cloudwatchLogsTestdata(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonTxt, err := ioutil.ReadFile("testdata/1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Records []json.RawMessage `json:"records"`
+	}
+	err = json.Unmarshal(jsonTxt, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kinesisRec := func(seq string, data []byte) events.KinesisEventRecord {
+		return events.KinesisEventRecord{
+			EventSource: "aws:kinesis",
+			Kinesis: events.KinesisRecord{
+				SequenceNumber: seq,
+				PartitionKey:   "pk",
+				Data:           data,
+			},
+		}
+	}
+
+	evt := events.KinesisEvent{
+		Records: []events.KinesisEventRecord{
+			kinesisRec("1", buf.Bytes()),
+			kinesisRec("2", doc.Records[1]),
+			kinesisRec("3", jsonTxt),
+			kinesisRec("4", []byte("garbage")),
+		},
+	}
+
+	resp, err := server.Handler(context.Background(), mustMarshal(t, evt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := events.KinesisEventResponse{
+		BatchItemFailures: []events.KinesisBatchItemFailure{
+			{ItemIdentifier: "4"},
+		},
+	}
+	if !cmp.Equal(resp, expect) {
+		t.Fatal(cmp.Diff(resp, expect))
+	}
+
+	if len(snsMessages) != 3 {
+		t.Fatalf("expected 3 sns messages but got %d", len(snsMessages))
+	}
+}
+
+// cloudwatchLogsTestdata returns the records from testdata/1.json as
+// CloudWatch Logs subscription data, plus one invalid log event.
+func cloudwatchLogsTestdata(t *testing.T) events.CloudwatchLogsData {
+	t.Helper()
+
+	jsonTxt, err := ioutil.ReadFile("testdata/1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Records []json.RawMessage `json:"records"`
+	}
+	err = json.Unmarshal(jsonTxt, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := events.CloudwatchLogsData{
+		Owner:       "123456789",
+		LogGroup:    "aws-cloudtrail-logs-123456789",
+		LogStream:   "123456789_CloudTrail_us-east-1",
+		MessageType: "DATA_MESSAGE",
+	}
+	for i, rec := range doc.Records {
+		data.LogEvents = append(data.LogEvents, events.CloudwatchLogsLogEvent{
+			ID:      fmt.Sprintf("%d", i),
+			Message: string(rec),
+		})
+	}
+	data.LogEvents = append(data.LogEvents, events.CloudwatchLogsLogEvent{
+		ID:      "not-json",
+		Message: "not json",
+	})
+
+	return data
+}
+
+func TestStreamRecords(t *testing.T) {
+	checks := []struct {
+		doc       string
+		expectIDs []string
+		expectErr bool
+	}{
+		{
+			doc:       `{"Records": [{"eventID": "a"}, {"eventID": "b", "nested": {"x": [1, {"y": 2}]}}]}`,
+			expectIDs: []string{"a", "b"},
+		},
+		{
+			doc:       `{"other": {"Records": [{"eventID": "skipped"}]}, "records": [{"eventID": "a"}], "after": [[], {}]}`,
+			expectIDs: []string{"a"},
+		},
+		{
+			doc: `{"Records": null}`,
+		},
+		{
+			doc: `{}`,
+		},
+		{
+			doc:       `{"eventID": "a", "eventName": "CreateUser"}`,
+			expectIDs: []string{"a"},
+		},
+		{
+			doc:       "{\"eventID\": \"a\"}\n{\"eventID\": \"b\"}\n{\"Records\": [{\"eventID\": \"c\"}]}\n",
+			expectIDs: []string{"a", "b", "c"},
+		},
+		{
+			doc:       `{"Records": [{"eventID": "a"}, {"eventID": `,
+			expectIDs: []string{"a"},
+			expectErr: true,
+		},
+		{
+			doc:       `{"Records": {"eventID": "a"}}`,
+			expectErr: true,
+		},
+		{
+			doc:       `[]`,
+			expectErr: true,
+		},
+	}
+
+	for _, check := range checks {
+		var ids []string
+		count, err := streamRecords(bytes.NewBufferString(check.doc), func(rec map[string]interface{}) {
+			ids = append(ids, rec["eventID"].(string))
+		})
+		if check.expectErr && err == nil {
+			t.Errorf("expected error for %s", check.doc)
+		} else if !check.expectErr && err != nil {
+			t.Errorf("unexpected error for %s: %s", check.doc, err)
+		}
+		if !cmp.Equal(ids, check.expectIDs) {
+			t.Errorf("%s: %s", check.doc, cmp.Diff(ids, check.expectIDs))
+		}
+		if count != len(check.expectIDs) {
+			t.Errorf("%s: expected count %d but got %d", check.doc, len(check.expectIDs), count)
+		}
+	}
+}
+
+func TestBatchConcurrency(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	q, err := gojq.Parse(`select(.eventName == "CreateUser")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := gojq.Compile(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := &slowDest{delay: 5 * time.Millisecond}
+	s := server{
+		ruleWorkers:     4,
+		deliveryWorkers: 4,
+		rules: []Rule{
+			{
+				name:      "Create User",
+				matchMode: matchFirst,
+				query:     code,
+				dests:     []destination.Destination{dest, dest},
+			},
+		},
+	}
+
+	b := s.newBatch(log15.New())
+	for i := 0; i < 50; i++ {
+		b.add(map[string]interface{}{
+			"eventName": "CreateUser",
+			"eventID":   fmt.Sprintf("evt-%d", i),
+		})
+		b.add(map[string]interface{}{
+			"eventName": "ListUsers",
+		})
+	}
+	b.complete()
+
+	if b.recordCount != 100 {
+		t.Fatalf("expected 100 records but got %d", b.recordCount)
+	}
+	if b.matchCount != 50 {
+		t.Fatalf("expected 50 matches but got %d", b.matchCount)
+	}
+	if dest.sent != 100 {
+		t.Fatalf("expected 100 sends to be complete but got %d", dest.sent)
+	}
+}
+
+type slowDest struct {
+	delay time.Duration
+	mu    sync.Mutex
+	sent  int
+}
+
+func (d *slowDest) Send(name, desc string, rec map[string]interface{}, matchObj interface{}) error {
+	time.Sleep(d.delay)
+	d.mu.Lock()
+	d.sent++
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *slowDest) ID() string {
+	return "slow"
+}
+
+func (d *slowDest) Type() string {
+	return "slow"
+}
+
+func TestConfigCache(t *testing.T) {
+	server := setupTestServer(t, testSNSConfig)
+	lgr := log15.New()
+
+	err := server.loadConfig(lgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstRules := server.rules
+	firstState := server.state
+
+	// unchanged config should not be reloaded
+	err = server.loadConfig(lgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &server.rules[0] != &firstRules[0] {
+		t.Fatal("expected cached rules to be reused")
+	}
+
+	// changed config should be picked up
+	updated := strings.Replace(testSNSConfig, `name = "Create User"`, `name = "Create IAM User"`, 1)
+	putTestConfig(t, updated)
+
+	err = server.loadConfig(lgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.rules[0].name != "Create IAM User" {
+		t.Fatalf("expected updated rule name but got %q", server.rules[0].name)
+	}
+	if server.state != firstState {
+		t.Fatal("expected state store to be kept when [state_store] is unchanged")
+	}
+
+	// changing [state_store] replaces the store
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	putTestConfig(t, fmt.Sprintf("[state_store]\ntype = \"file\"\npath = %q\n", statePath)+updated)
+	err = server.loadConfig(lgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.state.(*statestore.File); !ok {
+		t.Fatalf("expected file state store but got %T", server.state)
+	}
+	putTestConfig(t, updated)
+	err = server.loadConfig(lgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// within the ttl changes are not picked up
+	os.Setenv("CONFIG_CACHE_TTL", "1h")
+	defer os.Unsetenv("CONFIG_CACHE_TTL")
+
+	putTestConfig(t, testSNSConfig)
+	err = server.loadConfig(lgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.rules[0].name != "Create IAM User" {
+		t.Fatalf("expected cached rule name but got %q", server.rules[0].name)
+	}
+
+	// once the ttl expires the config is revalidated
+	server.confLoadedAt = server.confLoadedAt.Add(-2 * time.Hour)
+	err = server.loadConfig(lgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.rules[0].name != "Create User" {
+		t.Fatalf("expected updated rule name but got %q", server.rules[0].name)
+	}
+
+	// if revalidation fails the cached config is kept
+	os.Unsetenv("CONFIG_CACHE_TTL")
+	awsstub.S3GetObj = func(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		return nil, awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), http.StatusServiceUnavailable, "")
+	}
+	err = server.loadConfig(lgr)
+	awsstub.S3GetObj = fakeGetObj
+	if err != nil {
+		t.Fatalf("expected cached config to be used but got err: %s", err)
+	}
+	if server.rules[0].name != "Create User" {
+		t.Fatalf("expected cached rule name but got %q", server.rules[0].name)
+	}
+
+	// an invalid config is not cached
+	putTestConfig(t, "[[rule]]\nname = 'no jq_match'\n")
+	err = server.loadConfig(lgr)
+	if err == nil {
+		t.Fatal("expected invalid config to fail to load")
+	}
+	if server.confSrc != "" {
+		t.Fatal("expected invalid config to not be cached")
+	}
+}
+
+func TestProcessLocalFile(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "tattletail.toml")
+	err := ioutil.WriteFile(confPath, []byte(testSNSConfig), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jsonTxt, err := ioutil.ReadFile("testdata/1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(jsonTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzPath := filepath.Join(dir, "1.json.gz")
+	err = ioutil.WriteFile(gzPath, buf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newServer()
+	err = s.loadLocalConfig(log15.New(), confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	s.replaceDestinations(&dryRunDest{w: &out})
+
+	for _, fname := range []string{"testdata/1.json", gzPath} {
+		err = s.processLocalFile(log15.New(), fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	line := `rule="Create User" event_id="692d22af-1b8a-4a40-bd87-e290897e9e95" match="username: user1"` + "\n"
+	expect := line + line
+	if out.String() != expect {
+		t.Fatal(cmp.Diff(out.String(), expect))
+	}
+}
+
+func TestLocalStateFile(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "state.json")
+	confPath := filepath.Join(dir, "tattletail.toml")
+	conf := fmt.Sprintf("dedup_ttl = \"1h\"\n\n[state_store]\ntype = \"file\"\npath = %q\n", statePath) + testSNSConfig
+	err := ioutil.WriteFile(confPath, []byte(conf), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second run is deduplicated using the state file from the first
+	expect := []string{
+		`rule="Create User" event_id="692d22af-1b8a-4a40-bd87-e290897e9e95" match="username: user1"` + "\n",
+		"",
+	}
+	for i, want := range expect {
+		s := newServer()
+		err = s.loadLocalConfig(log15.New(), confPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		s.replaceDestinations(&dryRunDest{w: &out})
+
+		err = s.processLocalFile(log15.New(), "testdata/1.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != want {
+			t.Fatalf("run %d: %s", i, cmp.Diff(out.String(), want))
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	conf := `
+[[rule]]
+name = "bad jq"
+jq_match = 'select(.eventName == '
+destinations = ["missing"]
+
+[[rule]]
+name = "undefined function"
+jq_match = 'not_a_function(.)'
+jq_transform = '{match: $match, other: $other}'
+match_mode = "sometimes"
+severity = "urgent"
+group_by = '.sourceIPAddress'
+
+[[rule]]
+name = "typo"
+destinatons = ["Default SNS"]
+type = "threshold"
+retention = "forever"
+
+[[rule]]
+name = "short sequence"
+type = "sequence"
+window = "1h"
+
+[[rule.step]]
+jq_match = 'select(.eventName == "StopLogging")'
+
+[[rule.test]]
+record = '{"eventName": "StopLogging"}'
+expect_match = false
+
+[[destination]]
+id = "Default SNS"
+type = "sns"
+sns_arn = "arn:aws:sns:us-east-1:1234567890:cloudtail_alert"
+
+[[destination]]
+id = "Default SNS"
+type = "pigeon"
+
+[[destination]]
+id = "Unused"
+type = "sns"
+sns_arn = "not-an-arn"
+`
+
+	s := newServer()
+	problems := s.validateConfig(strings.NewReader(conf))
+
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+
+	expect := []string{
+		`warning: unknown config key "rule.destinatons"`,
+		`error: duplicate destinations with same id: "Default SNS"`,
+		`error: invalid destination type "pigeon" for destination id="Default SNS" idx=1`,
+		"error: invalid destination config for id=\"Unused\" idx=2: (sns) destination.sns_arn must be a full ARN beginning with `arn:` for \"Unused\"",
+		`error: jq_match err for rule name="bad jq" idx=0: parse err: unexpected token <EOF>`,
+		`error: unknown destination "missing" for rule name="bad jq" idx=0`,
+		`error: invalid severity "urgent" for rule name="undefined function" idx=1`,
+		`error: invalid match_mode "sometimes" for rule name="undefined function" idx=1`,
+		`warning: group_by and threshold are only used by threshold rules but are set for rule name="undefined function" idx=1`,
+		`error: jq_match err for rule name="undefined function" idx=1: compile err: function not defined: not_a_function/1`,
+		`error: jq_transform err for rule name="undefined function" idx=1: compile err: variable not defined: $other`,
+		`warning: no destinations for rule name="undefined function" idx=1`,
+		`warning: rule name="typo" idx=2: type "threshold" rules need a dynamodb state_store in lambda, the memory store is lost on every cold start`,
+		`error: invalid threshold rule name="typo" idx=2: threshold must be at least 1`,
+		`warning: seen_key, retention and learning_period are only used by first_seen rules but are set for rule name="typo" idx=2`,
+		`error: jq_match not defined for rule name="typo" idx=2`,
+		`warning: no destinations for rule name="typo" idx=2`,
+		`warning: rule name="short sequence" idx=3: type "sequence" rules need a dynamodb state_store in lambda, the memory store is lost on every cold start`,
+		`error: invalid sequence rule name="short sequence" idx=3: at least 2 steps are required`,
+		`error: tests are not supported for sequence rules but are set for rule name="short sequence" idx=3`,
+		`warning: no destinations for rule name="short sequence" idx=3`,
+		`warning: destination id="Default SNS" is not used by any rule`,
+		`warning: destination id="Unused" is not used by any rule`,
+	}
+
+	if !cmp.Equal(got, expect) {
+		t.Fatal(cmp.Diff(got, expect))
+	}
+
+	problems = s.validateConfig(strings.NewReader(testSNSConfig))
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems with valid config but got %v", problems)
+	}
+}
+
+func TestRuleTests(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	conf := testSNSConfig + `
+[[rule]]
+name = "Create User Tested"
+jq_match = 'select(.eventName == "CreateUser") | {user: .responseElements.user.userName}'
+destinations = ["Default SNS"]
+
+[[rule.test]]
+name = "inline"
+record = '{"eventName": "CreateUser", "responseElements": {"user": {"userName": "bob"}}}'
+expect_match = true
+expect_match_object = '{"user": "bob"}'
+
+[[rule.test]]
+name = "from file"
+record_file = "testdata/1.json"
+event_id = "692d22af-1b8a-4a40-bd87-e290897e9e95"
+expect_match = true
+expect_match_object = '{"user": "user1"}'
+
+[[rule.test]]
+name = "no match"
+record_file = "testdata/1.json"
+event_id = "b788100d-c21b-4575-a09f-5d01483d28b8"
+expect_match = false
+
+[[rule.test]]
+name = "wrong object"
+record = '{"eventName": "CreateUser", "responseElements": {"user": {"userName": "bob"}}}'
+expect_match = true
+expect_match_object = '{"user": "alice"}'
+
+[[rule.test]]
+name = "wrong expectation"
+record = '{"eventName": "DeleteUser"}'
+expect_match = true
+
+[[rule.test]]
+name = "ambiguous file"
+record_file = "testdata/1.json"
+expect_match = false
+`
+
+	s := newServer()
+	err := s.loadConfigFrom(log15.New(), strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed config.Config
+	_, err = toml.Decode(conf, &parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := s.runRuleTests(log15.New(), parsed, ".")
+
+	var got []string
+	for _, res := range results {
+		got = append(got, strings.SplitN(res.String(), "\n", 2)[0])
+	}
+
+	expect := []string{
+		`PASS rule="Create User Tested" test="inline"`,
+		`PASS rule="Create User Tested" test="from file"`,
+		`PASS rule="Create User Tested" test="no match"`,
+		`FAIL rule="Create User Tested" test="wrong object": match object mismatch:`,
+		`FAIL rule="Create User Tested" test="wrong expectation": expected match=true but got match=false`,
+		`FAIL rule="Create User Tested" test="ambiguous file": record_file contains 3 records; set event_id to select one`,
+	}
+
+	if !cmp.Equal(got, expect) {
+		t.Fatal(cmp.Diff(got, expect))
+	}
+}
+
+func TestReplay(t *testing.T) {
+	snsMessages = snsMessages[:0]
+	server := setupTestServer(t, testSNSConfig+`
+[[rule]]
+name = "List"
+jq_match = 'select(.eventName | startswith("List"))'
+destinations = ["Default SNS"]
+`)
+	awsstub.S3ListObjsV2Pages = fakeListObjsV2Pages
+
+	err := server.loadConfig(log15.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := "replay-bucket"
+	for _, key := range []string{
+		"AWSLogs/111111111111/CloudTrail/us-east-1/2021/07/09/before.json.gz",
+		"AWSLogs/111111111111/CloudTrail/us-east-1/2021/07/10/a.json.gz",
+		"AWSLogs/111111111111/CloudTrail/us-east-1/2021/07/11/b.json.gz",
+		"AWSLogs/111111111111/CloudTrail/us-west-2/2021/07/10/c.json.gz",
+		"AWSLogs/222222222222/CloudTrail/us-east-1/2021/07/11/d.json.gz",
+		"AWSLogs/222222222222/CloudTrail/us-east-1/2021/07/12/after.json.gz",
+	} {
+		putGzTestdata(t, bucket, key, "testdata/1.json")
+	}
+
+	opts := replayOptions{
+		bucket: bucket,
+		prefix: "AWSLogs",
+		start:  time.Date(2021, 7, 10, 0, 0, 0, 0, time.UTC),
+		end:    time.Date(2021, 7, 11, 0, 0, 0, 0, time.UTC),
+	}
+
+	result, err := server.replay(log15.New(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.fileCount != 4 {
+		t.Fatalf("expected 4 files but got %d", result.fileCount)
+	}
+	expect := map[string]int{
+		"Create User": 4,
+		"List":        8,
+	}
+	if !cmp.Equal(result.matches, expect) {
+		t.Fatal(cmp.Diff(result.matches, expect))
+	}
+	if len(snsMessages) != 0 {
+		t.Fatalf("expected no alerts to be sent but got %d", len(snsMessages))
+	}
+
+	// filter by account and region, forwarding to a destination
+	opts.accounts = []string{"111111111111"}
+	opts.regions = []string{"us-west-2"}
+	opts.destID = "Default SNS"
+
+	result, err = server.replay(log15.New(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.fileCount != 1 {
+		t.Fatalf("expected 1 file but got %d", result.fileCount)
+	}
+	if len(snsMessages) != 3 {
+		t.Fatalf("expected 3 alerts to be sent but got %d", len(snsMessages))
+	}
+}
+
+func TestRuleExceptions(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	conf := `
+[[rule]]
+name = "Modifications"
+jq_match = 'select(.readOnly | not)'
+destinations = ["Default SNS"]
+
+[[rule.exception]]
+reason = "terraform ci role"
+field = "userIdentity.arn"
+values = ["arn:aws:sts::123456789:assumed-role/terraform/*"]
+
+[[rule.exception]]
+reason = "office network"
+field = "sourceIPAddress"
+cidrs = ["10.0.0.0/8", "192.168.1.0/24"]
+jq_match = '.eventName == "PutObject"'
+
+[[rule.exception]]
+reason = "expired"
+expires = "2020-01-01"
+jq_match = 'true'
+
+[[destination]]
+id = "Default SNS"
+type = "sns"
+sns_arn = "arn:aws:sns:us-east-1:1234567890:cloudtail_alert"
+`
+
+	s := newServer()
+	err := s.loadConfigFrom(log15.New(), strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	s.replaceDestinations(&dryRunDest{w: &out})
+	s.ruleWorkers = 1
+	s.deliveryWorkers = 1
+
+	rec := func(id, arn, ip, evtName string) map[string]interface{} {
+		return map[string]interface{}{
+			"eventID":         id,
+			"eventName":       evtName,
+			"readOnly":        false,
+			"sourceIPAddress": ip,
+			"userIdentity": map[string]interface{}{
+				"arn": arn,
+			},
+		}
+	}
+
+	b := s.newBatch(log15.New())
+	b.add(rec("terraform", "arn:aws:sts::123456789:assumed-role/terraform/session-1", "1.1.1.1", "CreateUser"))
+	b.add(rec("office-putobject", "arn:aws:iam::123456789:user/bob", "10.1.2.3", "PutObject"))
+	b.add(rec("office-createuser", "arn:aws:iam::123456789:user/bob", "10.1.2.3", "CreateUser"))
+	b.add(rec("other-network", "arn:aws:iam::123456789:user/bob", "192.168.2.1", "PutObject"))
+	b.add(rec("other-role", "arn:aws:sts::123456789:assumed-role/terraform-admin/session-1", "1.1.1.1", "CreateUser"))
+	b.complete()
+
+	var gotIDs []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		gotIDs = append(gotIDs, strings.Split(line, `"`)[3])
+	}
+
+	expect := []string{"office-createuser", "other-network", "other-role"}
+	if !cmp.Equal(gotIDs, expect) {
+		t.Fatal(cmp.Diff(gotIDs, expect))
+	}
+
+	for _, bad := range []config.Exception{
+		{Reason: "no conditions"},
+		{Field: "sourceIPAddress"},
+		{Values: []string{"foo"}},
+		{Field: "sourceIPAddress", CIDRs: []string{"10.0.0.0/33"}},
+		{JQMatch: "true", Expires: "next tuesday"},
+		{JQMatch: "not_a_function"},
+	} {
+		_, err := newException(bad)
+		if err == nil {
+			t.Errorf("expected error for exception %+v", bad)
+		}
+	}
+}
+
+func TestSuppressions(t *testing.T) {
+	var completeCtx []interface{}
+	log15.Root().SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+		if r.Msg == "processing_complete" {
+			completeCtx = r.Ctx
+		}
+		return nil
+	}))
+	defer log15.Root().SetHandler(log15.DiscardHandler())
+
+	conf := `
+[[suppress]]
+name = "cloudtrail service"
+field = "userIdentity.invokedBy"
+values = ["cloudtrail.amazonaws.com"]
+
+[[suppress]]
+name = "ci"
+jq_match = '.userIdentity.arn | test("/ci-runner/")'
+reason = "ci runs terraform constantly"
+
+[[suppress]]
+name = "expired"
+expires = "2001-01-01T00:00:00Z"
+jq_match = 'true'
+
+[[rule]]
+name = "Everything"
+jq_match = '.'
+destinations = ["Default SNS"]
+
+[[destination]]
+id = "Default SNS"
+type = "sns"
+sns_arn = "arn:aws:sns:us-east-1:1234567890:cloudtail_alert"
+`
+
+	s := newServer()
+	err := s.loadConfigFrom(log15.New(), strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	s.replaceDestinations(&dryRunDest{w: &out})
+
+	b := s.newBatch(log15.New())
+	b.add(map[string]interface{}{
+		"eventID": "1",
+		"userIdentity": map[string]interface{}{
+			"invokedBy": "cloudtrail.amazonaws.com",
+		},
+	})
+	b.add(map[string]interface{}{
+		"eventID": "2",
+		"userIdentity": map[string]interface{}{
+			"arn": "arn:aws:sts::123456789:assumed-role/ci-runner/1234",
+		},
+	})
+	b.add(map[string]interface{}{
+		"eventID": "3",
+		"userIdentity": map[string]interface{}{
+			"arn": "arn:aws:sts::123456789:assumed-role/ci-runner/5678",
+		},
+	})
+	b.add(map[string]interface{}{
+		"eventID": "4",
+		"userIdentity": map[string]interface{}{
+			"arn": "arn:aws:iam::123456789:user/alice",
+		},
+	})
+	b.complete()
+
+	if b.matchCount != 1 {
+		t.Fatalf("expected 1 match but got %d", b.matchCount)
+	}
+	if !cmp.Equal(b.suppressHits, []int64{1, 2, 0}) {
+		t.Fatalf("unexpected suppress hits: %v", b.suppressHits)
+	}
+
+	ctx := make(map[interface{}]interface{})
+	for i := 0; i+1 < len(completeCtx); i += 2 {
+		ctx[completeCtx[i]] = completeCtx[i+1]
+	}
+	if ctx["suppressed_count"] != int64(3) {
+		t.Errorf("unexpected suppressed_count: %v", ctx["suppressed_count"])
+	}
+	if ctx["suppress_hits"] != "cloudtrail service:1,ci:2,expired:0" {
+		t.Errorf("unexpected suppress_hits: %v", ctx["suppress_hits"])
+	}
+}
+
+func TestDedup(t *testing.T) {
+	snsMessages = snsMessages[:0]
+	server := setupTestServer(t, "dedup_ttl = \"1h\"\n"+testSNSConfig+`
+[[rule]]
+name = "Any List"
+jq_match = 'select(.eventName | startswith("List")) | .eventName'
+dedup_key = '$match'
+destinations = ["Default SNS"]
+`)
+
+	bucketName := "dedup-bucket"
+	putGzTestdata(t, bucketName, "1.json.gz", "testdata/1.json")
+	putGzTestdata(t, bucketName, "retry.json.gz", "testdata/1.json")
+
+	for _, key := range []string{"1.json.gz", "1.json.gz", "retry.json.gz"} {
+		evt := events.S3Event{
+			Records: []events.S3EventRecord{
+				{
+					EventSource: "aws:s3",
+					S3: events.S3Entity{
+						Bucket: events.S3Bucket{Name: bucketName},
+						Object: events.S3Object{Key: key},
+					},
+				},
+			},
+		}
+		_, err := server.Handler(context.Background(), mustMarshal(t, evt))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// testdata/1.json has one CreateUser record and the same ListAttachedRolePolicies
+	// record twice. Both rules should only alert once.
+	if len(snsMessages) != 2 {
+		t.Fatalf("expected 2 sns messages but got %d", len(snsMessages))
+	}
+
+	// alerts that fail to send to every destination don't count as sent
+	failing := &failDest{}
+	server.rules[0].dests = []destination.Destination{failing}
+	server.state = statestore.NewMemory()
+
+	rec := map[string]interface{}{
+		"eventID":   "retry-me",
+		"eventName": "CreateUser",
+	}
+	for i := 0; i < 2; i++ {
+		b := server.newBatch(log15.New())
+		b.add(rec)
+		b.complete()
+	}
+	if failing.attempts != 2 {
+		t.Fatalf("expected failed alert to be retried but got %d attempts", failing.attempts)
+	}
+}
+
+func TestStateRuleNames(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	rule := `
+[[rule]]
+jq_match = 'select(.eventName == "CreateUser")'
+`
+	checks := []struct {
+		conf   string
+		expect string
+	}{
+		{
+			conf:   rule + rule,
+			expect: "",
+		},
+		{
+			conf:   `dedup_ttl = "1h"` + "\n" + rule + rule,
+			expect: `invalid rule name="" idx=0: name must be set for rules that use dedup_ttl or type "threshold", "first_seen" or "sequence"`,
+		},
+		{
+			conf:   rule + "name = \"dup\"\ndedup_ttl = \"1h\"\n" + rule + "name = \"dup\"\n",
+			expect: `invalid rule name="dup" idx=0: name must be unique for rules that use dedup_ttl or type "threshold", "first_seen" or "sequence"`,
+		},
+	}
+
+	for i, check := range checks {
+		var got string
+		err := newServer().loadConfigFrom(log15.New(), strings.NewReader(check.conf))
+		if err != nil {
+			got = err.Error()
+		}
+		if got != check.expect {
+			t.Errorf("check %d: expected err %q but got %q", i, check.expect, got)
+		}
+
+		var lintGot string
+		problems := newServer().validateConfig(strings.NewReader(check.conf))
+		for _, p := range problems {
+			if strings.Contains(p.msg, "name must be") {
+				lintGot = p.msg
+				break
+			}
+		}
+		if lintGot != check.expect {
+			t.Errorf("check %d: expected lint problem %q but got %q", i, check.expect, lintGot)
+		}
+	}
+}
+
+func TestThresholdRules(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	conf := `
+rule_workers = 1
+
+[[rule]]
+name = "Console login failures"
+type = "threshold"
+jq_match = 'select(.eventName == "ConsoleLogin" and .responseElements.ConsoleLogin == "Failure")'
+group_by = '.sourceIPAddress'
+threshold = 3
+window = "5m"
+destinations = ["Default SNS"]
+
+[[destination]]
+id = "Default SNS"
+type = "sns"
+sns_arn = "arn:aws:sns:us-east-1:1234567890:cloudtail_alert"
+`
+
+	s := newServer()
+	err := s.loadConfigFrom(log15.New(), strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	s.replaceDestinations(&dryRunDest{w: &out})
+
+	start := time.Date(2021, 7, 13, 15, 0, 0, 0, time.UTC)
+	failedLogin := func(id, ip string, offset time.Duration) map[string]interface{} {
+		return map[string]interface{}{
+			"eventID":         id,
+			"eventName":       "ConsoleLogin",
+			"eventTime":       start.Add(offset).Format(time.RFC3339),
+			"sourceIPAddress": ip,
+			"responseElements": map[string]interface{}{
+				"ConsoleLogin": "Failure",
+			},
+		}
+	}
+
+	b := s.newBatch(log15.New())
+	b.add(failedLogin("1", "10.0.0.1", 0))
+	b.add(failedLogin("2", "10.0.0.1", time.Minute))
+	b.add(failedLogin("3", "10.0.0.2", time.Minute))
+	b.complete()
+
+	if out.Len() != 0 {
+		t.Fatalf("expected no alerts below the threshold but got: %s", out.String())
+	}
+
+	// counts carry across batches
+	b = s.newBatch(log15.New())
+	b.add(failedLogin("4", "10.0.0.1", 2*time.Minute))
+	b.add(failedLogin("5", "10.0.0.1", 3*time.Minute))
+	b.add(failedLogin("6", "10.0.0.2", 10*time.Minute))
+	// 1, 2, 4 and 5 are older than the window by now
+	b.add(failedLogin("7", "10.0.0.1", 10*time.Minute))
+	b.add(failedLogin("8", "10.0.0.1", 11*time.Minute))
+	b.complete()
+
+	expect := `rule="Console login failures" event_id="4" match={"count":3,"event_ids":["1","2","4"],"group":"10.0.0.1","match":{"eventID":"4","eventName":"ConsoleLogin","eventTime":"2021-07-13T15:02:00Z","responseElements":{"ConsoleLogin":"Failure"},"sourceIPAddress":"10.0.0.1"},"threshold":3,"window":"5m","window_start":"2021-07-13T15:00:00Z"}
+`
+	if out.String() != expect {
+		t.Fatalf("threshold alert mismatch got:\n%s\nexpected:\n%s", out.String(), expect)
+	}
+}
+
+func TestThresholdWindowBoundary(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	conf := `
+rule_workers = 1
+
+[[rule]]
+name = "Console login failures"
+type = "threshold"
+jq_match = 'select(.eventName == "ConsoleLogin" and .responseElements.ConsoleLogin == "Failure")'
+group_by = '.sourceIPAddress'
+threshold = 10
+window = "5m"
+destinations = ["Default SNS"]
+
+[[destination]]
+id = "Default SNS"
+type = "sns"
+sns_arn = "arn:aws:sns:us-east-1:1234567890:cloudtail_alert"
+`
+
+	s := newServer()
+	err := s.loadConfigFrom(log15.New(), strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	s.replaceDestinations(&dryRunDest{w: &out})
+
+	start := time.Date(2021, 7, 13, 15, 0, 0, 0, time.UTC)
+	failedLogin := func(id string, offset time.Duration) map[string]interface{} {
+		return map[string]interface{}{
+			"eventID":         id,
+			"eventName":       "ConsoleLogin",
+			"eventTime":       start.Add(offset).Format(time.RFC3339),
+			"sourceIPAddress": "10.0.0.1",
+			"responseElements": map[string]interface{}{
+				"ConsoleLogin": "Failure",
+			},
+		}
+	}
+
+	b := s.newBatch(log15.New())
+	b.add(failedLogin("0", 0))
+	b.complete()
+
+	// a burst of 10 failures within 18 seconds that straddles the point
+	// 5 minutes after the first failure
+	b = s.newBatch(log15.New())
+	for i := 1; i <= 10; i++ {
+		b.add(failedLogin(fmt.Sprint(i), 4*time.Minute+48*time.Second+time.Duration(2*i)*time.Second))
+	}
+	b.complete()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], `rule="Console login failures" event_id="10" match={"count":10,"event_ids":["1","2","3","4","5","6","7","8","9","10"]`) {
+		t.Fatalf("expected one alert for the burst but got:\n%s", out.String())
+	}
+	if !strings.Contains(lines[0], `"window_start":"2021-07-13T15:04:50Z"`) {
+		t.Fatalf("expected the window to start at the first failure of the burst but got:\n%s", out.String())
+	}
+}
+
+func TestFirstSeenRules(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	conf := `
+rule_workers = 1
+
+[[rule]]
+name = "Root login from new IP"
+type = "first_seen"
+jq_match = 'select(.eventName == "ConsoleLogin" and .userIdentity.type == "Root")'
+seen_key = '.sourceIPAddress'
+learning_period = "1d"
+destinations = ["Default SNS"]
+
+[[destination]]
+id = "Default SNS"
+type = "sns"
+sns_arn = "arn:aws:sns:us-east-1:1234567890:cloudtail_alert"
+`
+
+	s := newServer()
+	err := s.loadConfigFrom(log15.New(), strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	s.replaceDestinations(&dryRunDest{w: &out})
+
+	start := time.Date(2021, 7, 13, 15, 0, 0, 0, time.UTC)
+	rootLogin := func(id, ip string, offset time.Duration) map[string]interface{} {
+		return map[string]interface{}{
+			"eventID":         id,
+			"eventName":       "ConsoleLogin",
+			"eventTime":       start.Add(offset).Format(time.RFC3339),
+			"sourceIPAddress": ip,
+			"userIdentity": map[string]interface{}{
+				"type": "Root",
+			},
+		}
+	}
+
+	b := s.newBatch(log15.New())
+	// learning period
+	b.add(rootLogin("1", "10.0.0.1", 0))
+	b.add(rootLogin("2", "10.0.0.2", time.Hour))
+	b.complete()
+
+	if out.Len() != 0 {
+		t.Fatalf("expected no alerts during the learning period but got: %s", out.String())
+	}
+
+	b = s.newBatch(log15.New())
+	b.add(rootLogin("3", "10.0.0.1", 48*time.Hour))
+	b.add(rootLogin("4", "10.0.0.3", 48*time.Hour))
+	b.add(rootLogin("5", "10.0.0.3", 49*time.Hour))
+	b.complete()
+
+	expect := `rule="Root login from new IP" event_id="4" match={"first_seen":"2021-07-15T15:00:00Z","match":{"eventID":"4","eventName":"ConsoleLogin","eventTime":"2021-07-15T15:00:00Z","sourceIPAddress":"10.0.0.3","userIdentity":{"type":"Root"}},"value":"10.0.0.3"}
+`
+	if out.String() != expect {
+		t.Fatalf("first_seen alert mismatch got:\n%s\nexpected:\n%s", out.String(), expect)
+	}
+
+	// a value whose alert couldn't be delivered anywhere is
+	// not marked as seen, so a retry alerts again
+	failing := &failDest{}
+	s.rules[0].dests = []destination.Destination{failing}
+	for i := 0; i < 2; i++ {
+		b = s.newBatch(log15.New())
+		b.add(rootLogin("6", "10.0.0.4", 50*time.Hour))
+		b.complete()
+	}
+	if failing.attempts != 2 {
+		t.Fatalf("expected the retry to alert again but got %d attempts", failing.attempts)
+	}
+}
+
+func TestSequenceRules(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	conf := `
+[[rule]]
+name = "New admin user"
+type = "sequence"
+window = "1h"
+join_key = '.requestParameters.userName'
+jq_transform = '{user: $match.join_key, events: $match.event_ids, steps: [$match.steps[].step]}'
+destinations = ["Default SNS"]
+
+[[rule.step]]
+name = "create user"
+jq_match = 'select(.eventName == "CreateUser")'
+
+[[rule.step]]
+name = "create key"
+jq_match = 'select(.eventName == "CreateAccessKey")'
+
+[[rule.step]]
+name = "attach admin"
+jq_match = 'select(.eventName == "AttachUserPolicy" and .requestParameters.policyArn == "arn:aws:iam::aws:policy/AdministratorAccess")'
+
+[[destination]]
+id = "Default SNS"
+type = "sns"
+sns_arn = "arn:aws:sns:us-east-1:1234567890:cloudtail_alert"
+`
+
+	s := newServer()
+	err := s.loadConfigFrom(log15.New(), strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	s.replaceDestinations(&dryRunDest{w: &out})
+
+	start := time.Date(2021, 7, 13, 15, 0, 0, 0, time.UTC)
+	iamEvent := func(id, name, user string, offset time.Duration) map[string]interface{} {
+		return map[string]interface{}{
+			"eventID":   id,
+			"eventName": name,
+			"eventTime": start.Add(offset).Format(time.RFC3339),
+			"requestParameters": map[string]interface{}{
+				"userName":  user,
+				"policyArn": "arn:aws:iam::aws:policy/AdministratorAccess",
+			},
+		}
+	}
+
+	b := s.newBatch(log15.New())
+	b.add(iamEvent("1", "CreateUser", "bob", 0))
+	b.add(iamEvent("3", "AttachUserPolicy", "bob", 20*time.Minute))
+	b.add(iamEvent("4", "CreateUser", "alice", 0))
+	b.add(iamEvent("5", "CreateAccessKey", "alice", 10*time.Minute))
+	b.complete()
+
+	if out.Len() != 0 {
+		t.Fatalf("expected no alerts for partial sequences but got: %s", out.String())
+	}
+
+	// records can arrive out of order
+	b = s.newBatch(log15.New())
+	b.add(iamEvent("2", "CreateAccessKey", "bob", 10*time.Minute))
+	// outside of the window
+	b.add(iamEvent("6", "AttachUserPolicy", "alice", 2*time.Hour))
+	b.complete()
+
+	// the dry run destination prints the match object and the
+	// jq_transform output
+	expect := `rule="New admin user" event_id="2" match={"event_ids":["1","2","3"],"join_key":"bob","steps":[{"event_id":"1","event_time":"2021-07-13T15:00:00Z","record":{"eventID":"1","eventName":"CreateUser","eventTime":"2021-07-13T15:00:00Z","requestParameters":{"policyArn":"arn:aws:iam::aws:policy/AdministratorAccess","userName":"bob"}},"step":"create user"},{"event_id":"2","event_time":"2021-07-13T15:10:00Z","record":{"eventID":"2","eventName":"CreateAccessKey","eventTime":"2021-07-13T15:10:00Z","requestParameters":{"policyArn":"arn:aws:iam::aws:policy/AdministratorAccess","userName":"bob"}},"step":"create key"},{"event_id":"3","event_time":"2021-07-13T15:20:00Z","record":{"eventID":"3","eventName":"AttachUserPolicy","eventTime":"2021-07-13T15:20:00Z","requestParameters":{"policyArn":"arn:aws:iam::aws:policy/AdministratorAccess","userName":"bob"}},"step":"attach admin"}]} payload={"events":["1","2","3"],"steps":["create user","create key","attach admin"],"user":"bob"}
+`
+	if out.String() != expect {
+		t.Fatalf("sequence alert mismatch got:\n%s\nexpected:\n%s", out.String(), expect)
+	}
+
+	// completed sequences only alert once
+	out.Reset()
+	b = s.newBatch(log15.New())
+	b.add(iamEvent("3", "AttachUserPolicy", "bob", 20*time.Minute))
+	b.add(iamEvent("2", "CreateAccessKey", "bob", 10*time.Minute))
+	b.complete()
+
+	if out.Len() != 0 {
+		t.Fatalf("expected completed sequence to not alert again but got: %s", out.String())
+	}
+
+	// large records are trimmed in the partial sequence state
+	big := iamEvent("7", "CreateUser", "carol", 0)
+	big["requestParameters"].(map[string]interface{})["tags"] = strings.Repeat("x", 2*maxSequenceRecordLen)
+	b = s.newBatch(log15.New())
+	b.add(big)
+	b.complete()
+
+	stateVal, ok, err := s.state.Get(`sequence:New admin user:"carol"`)
+	if err != nil || !ok {
+		t.Fatalf("expected partial sequence state ok=%t err=%v", ok, err)
+	}
+	if len(stateVal) > maxSequenceRecordLen {
+		t.Fatalf("expected trimmed record in state but state is %d bytes", len(stateVal))
+	}
+
+	b = s.newBatch(log15.New())
+	b.add(iamEvent("8", "CreateAccessKey", "carol", 10*time.Minute))
+	b.add(iamEvent("9", "AttachUserPolicy", "carol", 20*time.Minute))
+	b.complete()
+
+	expect = ` payload={"events":["7","8","9"],"steps":["create user","create key","attach admin"],"user":"carol"}
+`
+	if !strings.HasPrefix(out.String(), `rule="New admin user" event_id="9" match=`) || !strings.HasSuffix(out.String(), expect) {
+		t.Fatalf("sequence alert mismatch got:\n%s\nexpected payload:\n%s", out.String(), expect)
+	}
+	if !strings.Contains(out.String(), `"record_truncated":true`) {
+		t.Fatalf("expected the first step's record to be truncated but got:\n%s", out.String())
+	}
+}
+
+func TestLambdaStateStore(t *testing.T) {
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	rule := `
+[[rule]]
+name = "New regions"
+type = "first_seen"
+jq_match = 'select(.eventName == "RunInstances")'
+seen_key = '.awsRegion'
+`
+	dynamo := `
+[state_store]
+type = "dynamodb"
+dynamodb_table = "tattletail-state"
+`
+	checks := []struct {
+		conf     string
+		inLambda bool
+		expect   string
+	}{
+		{
+			conf:   rule,
+			expect: "",
+		},
+		{
+			conf:     rule,
+			inLambda: true,
+			expect:   `invalid rule name="New regions" idx=0: type "first_seen" rules need a dynamodb state_store in lambda, the memory store is lost on every cold start`,
+		},
+		{
+			conf:     "[state_store]\ntype = \"file\"\npath = \"" + filepath.Join(t.TempDir(), "state.json") + "\"\n" + rule,
+			inLambda: true,
+			expect:   `invalid rule name="New regions" idx=0: type "first_seen" rules need a dynamodb state_store in lambda, the file store is lost on every cold start`,
+		},
+		{
+			conf:     dynamo + rule,
+			inLambda: true,
+			expect:   "",
+		},
+		{
+			conf:     "[[rule]]\njq_match = 'select(.eventName == \"CreateUser\")'\n",
+			inLambda: true,
+			expect:   "",
+		},
+	}
+
+	for i, check := range checks {
+		s := newServer()
+		s.inLambda = check.inLambda
+
+		var got string
+		err := s.loadConfigFrom(log15.New(), strings.NewReader(check.conf))
+		if err != nil {
+			got = err.Error()
+		}
+		if got != check.expect {
+			t.Errorf("check %d: expected err %q but got %q", i, check.expect, got)
+		}
+	}
+
+	var warned bool
+	for _, p := range newServer().validateConfig(strings.NewReader(rule)) {
+		if p.warning && strings.Contains(p.msg, "need a dynamodb state_store") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("expected validate to warn about the memory state store")
+	}
+	for _, p := range newServer().validateConfig(strings.NewReader(dynamo + rule)) {
+		if strings.Contains(p.msg, "need a dynamodb state_store") {
+			t.Errorf("unexpected problem with a dynamodb state store: %s", p)
+		}
+	}
+}
+
+type failDest struct {
+	mu       sync.Mutex
+	attempts int
+}
+
+func (d *failDest) Send(name, desc string, rec map[string]interface{}, matchObj interface{}) error {
+	d.mu.Lock()
+	d.attempts++
+	d.mu.Unlock()
+	return fmt.Errorf("destination unavailable")
+}
+
+func (d *failDest) ID() string {
+	return "fail"
+}
+
+func (d *failDest) Type() string {
+	return "fail"
+}
+
+var testSNSConfig = `
+[[rule]]
+name = "Create User"
+jq_match = 'select(.eventName == "CreateUser") | "username: \(.responseElements.user.userName)"'
+destinations = ["Default SNS"]
+description = "A new IAM user has been created"
+
+[[destination]]
+id = "Default SNS"
+type = "sns"
+sns_arn = "arn:aws:sns:us-east-1:1234567890:cloudtail_alert"
+`
+
+// setupTestServer installs the fake aws functions, uploads config
+// to the fake s3 and returns a new server that will load it.
+func setupTestServer(t *testing.T, config string) *server {
+	t.Helper()
+
+	awsstub.S3GetObj = fakeGetObj
+	awsstub.S3GetObjWithContext = fakeGetObjWithContext
+	awsstub.SnsPublish = fakeSNSPublish
+	awsstub.SendEmail = fakeSendEmail
+
+	log15.Root().SetHandler(log15.DiscardHandler())
+
+	putTestConfig(t, config)
+
+	return newServer()
+}
+
+// putTestConfig uploads config to the fake s3 and points the
+// S3_CONFIG_* environment variables at it.
+func putTestConfig(t *testing.T, config string) {
+	t.Helper()
+
+	confBucket := "mandrake-Aquarius"
+	confKey := t.Name() + ".toml"
+	_, err := fakePutObj(&s3manager.UploadInput{
+		Body:   bytes.NewBufferString(config),
+		Key:    &confKey,
+		Bucket: &confBucket,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("S3_CONFIG_BUCKET", confBucket)
+	os.Setenv("S3_CONFIG_PATH", confKey)
+	os.Setenv("AWS_REGION", "us-east-1")
+}
+
+func putGzTestdata(t *testing.T, bucket, key, fname string) {
+	t.Helper()
+
+	jsonTxt, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(jsonTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fakePutObj(&s3manager.UploadInput{
+		Body:   &buf,
+		Key:    &key,
+		Bucket: &bucket,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) json.RawMessage {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
 func fakeGetObj(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
 	key := bucketKey{*i.Bucket, *i.Key}
-	if obj, found := fakeS3[key]; found {
+	fakeMu.Lock()
+	obj, found := fakeS3[key]
+	fakeMu.Unlock()
+	if found {
+		etag := fmt.Sprintf(`"%x"`, md5.Sum(obj))
+		if i.IfNoneMatch != nil && *i.IfNoneMatch == etag {
+			return nil, awserr.NewRequestFailure(awserr.New("NotModified", "Not Modified", nil), http.StatusNotModified, "")
+		}
 		out := &s3.GetObjectOutput{
 			Body: ioutil.NopCloser(bytes.NewReader(obj)),
+			ETag: &etag,
 		}
 		return out, nil
 	}
@@ -248,11 +2090,48 @@ func fakePutObj(i *s3manager.UploadInput, o ...func(*s3manager.Uploader)) (*s3ma
 	}
 
 	key := bucketKey{*i.Bucket, *i.Key}
+	fakeMu.Lock()
 	fakeS3[key] = b
+	fakeMu.Unlock()
 
 	return &s3manager.UploadOutput{}, nil
 }
 
+func fakeListObjsV2Pages(i *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	prefix := aws.StringValue(i.Prefix)
+	delim := aws.StringValue(i.Delimiter)
+
+	fakeMu.Lock()
+	var keys []string
+	for k := range fakeS3 {
+		if k.bucket == *i.Bucket && strings.HasPrefix(k.key, prefix) {
+			keys = append(keys, k.key)
+		}
+	}
+	fakeMu.Unlock()
+	sort.Strings(keys)
+
+	var (
+		out  s3.ListObjectsV2Output
+		seen = make(map[string]bool)
+	)
+	for _, k := range keys {
+		rest := strings.TrimPrefix(k, prefix)
+		if delim != "" && strings.Contains(rest, delim) {
+			cp := prefix + rest[:strings.Index(rest, delim)+len(delim)]
+			if !seen[cp] {
+				seen[cp] = true
+				out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(cp)})
+			}
+			continue
+		}
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(k)})
+	}
+
+	fn(&out, true)
+	return nil
+}
+
 type bucketKey struct {
 	bucket string
 	key    string
@@ -266,7 +2145,9 @@ func fakeSNSPublish(i *sns.PublishInput) (*sns.PublishOutput, error) {
 		panic(err)
 	}
 
+	fakeMu.Lock()
 	snsMessages = append(snsMessages, msg)
+	fakeMu.Unlock()
 	return nil, nil
 }
 
@@ -284,7 +2165,9 @@ func fakeSendEmail(i *ses.SendEmailInput) (*ses.SendEmailOutput, error) {
 		sendID: idStr,
 	}
 
+	fakeMu.Lock()
 	sentEmails = append(sentEmails, sent)
+	fakeMu.Unlock()
 
 	return &ses.SendEmailOutput{MessageId: &idStr}, nil
 }
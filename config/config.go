@@ -3,6 +3,33 @@ package config
 type Config struct {
 	Rules        []Rule        `toml:"rule"`
 	Destinations []Destination `toml:"destination"`
+
+	// RuleWorkers is the number of records evaluated concurrently.
+	// Defaults to the number of CPUs.
+	RuleWorkers int `toml:"rule_workers"`
+	// DeliveryWorkers is the number of alerts sent to destinations
+	// concurrently. Defaults to 8.
+	DeliveryWorkers int `toml:"delivery_workers"`
+
+	// Suppressions drop matching records before any rule is evaluated.
+	Suppressions []Suppression `toml:"suppress"`
+
+	// DedupTTL enables alert deduplication for every rule. Alerts for
+	// the same rule and eventID are only sent once within the ttl.
+	DedupTTL string `toml:"dedup_ttl"`
+
+	StateStore StateStore `toml:"state_store"`
+}
+
+type StateStore struct {
+	// Type is one of "memory" (default), "file" or "dynamodb"
+	Type string `toml:"type"`
+
+	// Path is for type "file"
+	Path string `toml:"path"`
+
+	// DynamoDBTable is for type "dynamodb"
+	DynamoDBTable string `toml:"dynamodb_table"`
 }
 
 type Rule struct {
@@ -10,21 +37,181 @@ type Rule struct {
 	JQMatch      string   `toml:"jq_match"`
 	Destinations []string `toml:"destinations"`
 	Desc         string   `toml:"description"`
+	// Severity is one of "critical", "error", "warning" or "info". It
+	// is used by destinations that support it, such as pagerduty.
+	Severity string `toml:"severity"`
+
+	// Type is one of "match" (the default), which alerts on every
+	// matching record, "threshold", "first_seen" or "sequence".
+	Type string `toml:"type"`
+
+	// JQTransform is an optional jq query run against each matched record.
+	// Its output is sent to the rule's destinations in place of the
+	// jq_match output. The jq_match output is available as $match.
+	JQTransform string `toml:"jq_transform"`
+
+	// MatchMode controls how multiple outputs of jq_match are handled.
+	// It is one of "first" (the default), "collect" or "each".
+	MatchMode string `toml:"match_mode"`
+
+	// Tests are fixtures that are run by the test-rules command.
+	Tests []RuleTest `toml:"test"`
+
+	// Exceptions suppress alerts for matching records that are
+	// known to be benign.
+	Exceptions []Exception `toml:"exception"`
+
+	// DedupKey is an optional jq query used instead of the eventID to
+	// deduplicate alerts. The match object is available as $match.
+	DedupKey string `toml:"dedup_key"`
+	// DedupTTL overrides the top level dedup_ttl for this rule.
+	// Set it to "0" to disable deduplication.
+	DedupTTL string `toml:"dedup_ttl"`
+
+	// GroupBy is an optional jq query for threshold rules. Matching
+	// records are counted separately for each distinct output. The
+	// match object is available as $match.
+	GroupBy string `toml:"group_by"`
+	// Threshold is the number of matching records in a group within
+	// Window that triggers an alert for threshold rules.
+	Threshold int `toml:"threshold"`
+	// Window is the duration (e.g. "5m") over which threshold rules
+	// count matching records, and within which all of the steps of a
+	// sequence rule must happen.
+	Window string `toml:"window"`
+
+	// SeenKey is a jq query for first_seen rules. The rule alerts the
+	// first time the query produces a value that hasn't been seen within
+	// Retention. The match object is available as $match.
+	SeenKey string `toml:"seen_key"`
+	// Retention is how long first_seen rules remember a value after it
+	// was last seen. Defaults to 90d.
+	Retention string `toml:"retention"`
+	// LearningPeriod is an optional duration after a first_seen rule
+	// starts during which values are recorded without alerting.
+	LearningPeriod string `toml:"learning_period"`
+
+	// Steps are the ordered events of a sequence rule. jq_match is
+	// optional for sequence rules; if set it filters the records
+	// that are checked against the steps.
+	Steps []SequenceStep `toml:"step"`
+	// JoinKey is an optional jq query for sequence rules. Only records
+	// with the same join key are part of the same sequence. The step's
+	// match object is available as $match.
+	JoinKey string `toml:"join_key"`
+}
+
+type SequenceStep struct {
+	Name string `toml:"name"`
+
+	// JQMatch matches records for this step. Like a rule's jq_match,
+	// only the first output is considered.
+	JQMatch string `toml:"jq_match"`
+	// JoinKey overrides the rule's join_key for this step.
+	JoinKey string `toml:"join_key"`
+}
+
+// Exception describes records that should not alert. All of the
+// conditions that are set must match for the exception to apply.
+type Exception struct {
+	// Reason is logged when an alert is suppressed.
+	Reason string `toml:"reason"`
+	// Expires is an optional date (2006-01-02) or RFC3339 timestamp
+	// after which the exception no longer applies.
+	Expires string `toml:"expires"`
+
+	// JQMatch matches records for which the query produces a value
+	// other than null or false.
+	JQMatch string `toml:"jq_match"`
+
+	// Field is a dotted path to a string field in the record (e.g.
+	// userIdentity.arn) that is checked against Values and CIDRs.
+	Field string `toml:"field"`
+	// Values are patterns the field must match. `*` matches any
+	// sequence of characters.
+	Values []string `toml:"values"`
+	// CIDRs are networks the field must be an IP address in.
+	CIDRs []string `toml:"cidrs"`
+}
+
+type RuleTest struct {
+	Name string `toml:"name"`
+
+	// Record is an inline JSON encoded CloudTrail record.
+	Record string `toml:"record"`
+	// RecordFile is a path to a file containing CloudTrail records,
+	// relative to the config file. If the file contains more than one
+	// record EventID selects which one to use.
+	RecordFile string `toml:"record_file"`
+	EventID    string `toml:"event_id"`
+
+	ExpectMatch bool `toml:"expect_match"`
+	// ExpectMatchObject is the optional JSON encoded match object
+	// the rule is expected to produce.
+	ExpectMatchObject string `toml:"expect_match_object"`
+}
+
+// Suppression is an Exception that applies to every rule.
+type Suppression struct {
+	// Name identifies the suppression in logs.
+	Name string `toml:"name"`
+	Exception
 }
 
 type Destination struct {
 	ID string `toml:"id"`
-	// Type is a string of "sns" "slack_webhook" "ses"
+	// Type is a string of "sns" "slack_webhook" "ses" "webhook" "pagerduty" "opsgenie"
+	// "msteams_webhook" "discord_webhook" "mattermost_webhook"
 	Type string `toml:"type"`
 
 	// SNSARN is for type "sns"
 	SNSARN string `toml:"sns_arn"`
 
-	// WebhookURL is for type "slack_webhook"
+	// WebhookURL is for types "slack_webhook", "webhook", "msteams_webhook",
+	// "discord_webhook" and "mattermost_webhook"
 	WebhookURL string `toml:"webhook_url"`
 
 	// ToEmails is for type "ses"
 	ToEmails []string `toml:"to_emails"`
 	// FromEmail is for type "ses"
 	FromEmail string `toml:"from_email"`
+
+	// Method is for type "webhook". Defaults to POST.
+	Method string `toml:"method"`
+	// Headers is for type "webhook"
+	Headers map[string]string `toml:"headers"`
+	// BodyTemplate is for type "webhook". It is a text/template
+	// rendered with the rule name, description, record and match.
+	BodyTemplate string `toml:"body_template"`
+	// HMACSecret is for type "webhook". If set, requests are signed
+	// with HMAC-SHA256.
+	HMACSecret string `toml:"hmac_secret"`
+
+	// RoutingKey is for type "pagerduty"
+	RoutingKey string `toml:"routing_key"`
+
+	// APIURL is for types "pagerduty" and "opsgenie". It overrides
+	// the base url of the API.
+	APIURL string `toml:"api_url"`
+
+	// APIKey is for type "opsgenie"
+	APIKey string `toml:"api_key"`
+	// Region is for type "opsgenie". It is "us" (default) or "eu".
+	Region string `toml:"region"`
+	// Responders is for type "opsgenie"
+	Responders []Responder `toml:"responders"`
+	// Tags is for type "opsgenie"
+	Tags []string `toml:"tags"`
+	// Priority is for type "opsgenie". It is one of P1-P5. If it isn't
+	// set the priority is based on the rule's severity.
+	Priority string `toml:"priority"`
+}
+
+// Responder is an Opsgenie team, user, escalation or schedule. Type is
+// required along with one of ID, Name or Username.
+type Responder struct {
+	Type     string `toml:"type"`
+	ID       string `toml:"id"`
+	Name     string `toml:"name"`
+	Username string `toml:"username"`
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/cloudtrail-tattletail/config"
+)
+
+// claimAlert records that an alert for rule and rec is being sent. It
+// returns the dedup key for the alert and whether an alert with the same
+// key has already been sent within the rule's dedup ttl.
+//
+// The key is the rule name plus the eventID (and the match object for
+// rules with match_mode "each"), or the output of the rule's dedup_key
+// query. If the key can't be determined or the state store fails the
+// alert is not treated as a duplicate.
+func (s *server) claimAlert(lgr log15.Logger, rule *Rule, evtID string, rec map[string]interface{}, matchObj interface{}) (string, bool) {
+	id := evtID
+	if rule.dedupKey != nil {
+		iter := rule.dedupKey.Run(rec, matchObj)
+		v, ok := iter.Next()
+		if err, isErr := v.(error); isErr {
+			lgr.Error("dedup_key_err", "err", err, "rule_name", rule.name, "evt_id", evtID)
+			return "", false
+		} else if !ok || v == nil {
+			return "", false
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		id = string(b)
+	} else if rule.matchMode == matchEach {
+		b, err := json.Marshal(matchObj)
+		if err != nil {
+			return "", false
+		}
+		id += ":" + string(b)
+	}
+
+	if id == "" {
+		return "", false
+	}
+
+	key := "dedup:" + rule.name + ":" + id
+	claimed, err := s.state.PutIfAbsent(key, nil, rule.dedupTTL)
+	if err != nil {
+		lgr.Error("dedup_state_store_err", "err", err, "rule_name", rule.name, "evt_id", evtID)
+		return "", false
+	}
+
+	return key, !claimed
+}
+
+// usesState reports whether rule keeps state in the state store, either
+// for deduplication or because of its type. State is keyed on the rule's
+// name, so these rules must have unique, non-empty names.
+func usesState(conf config.Config, rule config.Rule) bool {
+	switch rule.Type {
+	case ruleThreshold, ruleFirstSeen, ruleSequence:
+		return true
+	}
+	return rule.DedupTTL != "" || conf.DedupTTL != ""
+}
+
+// checkStateRuleName returns an error if rule uses state and its name is
+// empty or shared with another rule. nameCount is the number of rules
+// with each name.
+func checkStateRuleName(conf config.Config, rule config.Rule, nameCount map[string]int) error {
+	if !usesState(conf, rule) {
+		return nil
+	}
+	if rule.Name == "" {
+		return fmt.Errorf("name must be set for rules that use dedup_ttl or type %q, %q or %q", ruleThreshold, ruleFirstSeen, ruleSequence)
+	}
+	if nameCount[rule.Name] > 1 {
+		return fmt.Errorf("name must be unique for rules that use dedup_ttl or type %q, %q or %q", ruleThreshold, ruleFirstSeen, ruleSequence)
+	}
+	return nil
+}
+
+// checkSharedState returns an error if rule keeps state between records
+// in a store that only lasts as long as a single lambda instance. Cold
+// starts would reset counts, seen values and partial sequences.
+func checkSharedState(conf config.Config, rule config.Rule) error {
+	switch rule.Type {
+	case ruleThreshold, ruleFirstSeen, ruleSequence:
+	default:
+		return nil
+	}
+	storeType := conf.StateStore.Type
+	if storeType == "dynamodb" {
+		return nil
+	}
+	if storeType == "" {
+		storeType = "memory"
+	}
+	return fmt.Errorf("type %q rules need a dynamodb state_store in lambda, the %s store is lost on every cold start", rule.Type, storeType)
+}
+
+// ruleNameCount returns the number of rules with each name.
+func ruleNameCount(rules []config.Rule) map[string]int {
+	count := make(map[string]int)
+	for _, rule := range rules {
+		count[rule.Name]++
+	}
+	return count
+}
+
+// parseDuration is like time.ParseDuration but also accepts a
+// number of days, e.g. "90d".
+func parseDuration(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/itchyny/gojq"
+	"github.com/psanford/cloudtrail-tattletail/config"
+)
+
+// exception matches records that should not alert.
+type exception struct {
+	reason  string
+	expires time.Time
+
+	query  *gojq.Code
+	field  []string
+	values []*regexp.Regexp
+	nets   []*net.IPNet
+}
+
+func newException(c config.Exception) (*exception, error) {
+	e := exception{
+		reason: c.Reason,
+	}
+
+	if c.Expires != "" {
+		var err error
+		e.expires, err = parseExpires(c.Expires)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.JQMatch == "" && c.Field == "" {
+		return nil, fmt.Errorf("one of jq_match or field must be set")
+	}
+
+	if c.JQMatch != "" {
+		q, err := gojq.Parse(c.JQMatch)
+		if err != nil {
+			return nil, fmt.Errorf("jq_match err: parse err: %w", err)
+		}
+		e.query, err = gojq.Compile(q)
+		if err != nil {
+			return nil, fmt.Errorf("jq_match err: compile err: %w", err)
+		}
+	}
+
+	if c.Field != "" {
+		if len(c.Values) == 0 && len(c.CIDRs) == 0 {
+			return nil, fmt.Errorf("values or cidrs must be set for field %q", c.Field)
+		}
+		e.field = strings.Split(c.Field, ".")
+	} else if len(c.Values) > 0 || len(c.CIDRs) > 0 {
+		return nil, fmt.Errorf("field must be set when using values or cidrs")
+	}
+
+	for _, v := range c.Values {
+		e.values = append(e.values, globToRegexp(v))
+	}
+
+	for _, cidr := range c.CIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		e.nets = append(e.nets, n)
+	}
+
+	return &e, nil
+}
+
+// parseExpires parses a date or RFC3339 timestamp. A date expires at the
+// end of that day (UTC).
+func parseExpires(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid expires %q, must be YYYY-MM-DD or RFC3339", s)
+	}
+	return t, nil
+}
+
+func (e *exception) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// matches reports whether every condition of the exception matches rec.
+func (e *exception) matches(lgr log15.Logger, rec map[string]interface{}) bool {
+	if e.query != nil {
+		iter := e.query.Run(rec)
+		v, ok := iter.Next()
+		if !ok || v == nil || v == false {
+			return false
+		}
+		if err, ok := v.(error); ok {
+			lgr.Error("exception_match_err", "err", err, "reason", e.reason)
+			return false
+		}
+	}
+
+	if e.field == nil {
+		return true
+	}
+
+	val, ok := lookupField(rec, e.field).(string)
+	if !ok {
+		return false
+	}
+
+	if len(e.values) > 0 {
+		var found bool
+		for _, re := range e.values {
+			if re.MatchString(val) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(e.nets) > 0 {
+		ip := net.ParseIP(val)
+		if ip == nil {
+			return false
+		}
+		var found bool
+		for _, n := range e.nets {
+			if n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// suppression is a global exception that drops records
+// before any rule is evaluated.
+type suppression struct {
+	name string
+	*exception
+}
+
+// firstMatch returns the first unexpired exception that matches rec, or nil.
+func firstMatch(lgr log15.Logger, exceptions []*exception, rec map[string]interface{}) *exception {
+	now := time.Now()
+	for _, e := range exceptions {
+		if e.expired(now) {
+			continue
+		}
+		if e.matches(lgr, rec) {
+			return e
+		}
+	}
+	return nil
+}
+
+func lookupField(rec map[string]interface{}, path []string) interface{} {
+	var v interface{} = rec
+	for _, p := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[p]
+	}
+	return v
+}
+
+// globToRegexp converts a pattern where `*` matches any sequence of
+// characters (including `/`, unlike path.Match) into a regexp.
+func globToRegexp(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
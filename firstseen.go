@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/itchyny/gojq"
+	"github.com/psanford/cloudtrail-tattletail/config"
+)
+
+const (
+	defaultFirstSeenRetention = 90 * 24 * time.Hour
+
+	// firstSeenStartTTL is how long the start of a first_seen rule's
+	// learning period is remembered. It is effectively forever; if it
+	// expired the rule would go back to learning.
+	firstSeenStartTTL = 10 * 365 * 24 * time.Hour
+)
+
+// firstSeen holds the settings for rules with type "first_seen".
+type firstSeen struct {
+	key            *gojq.Code
+	retention      time.Duration
+	learningPeriod time.Duration
+}
+
+func newFirstSeen(rule config.Rule) (*firstSeen, error) {
+	if rule.SeenKey == "" {
+		return nil, errors.New("seen_key must be set")
+	}
+	q, err := gojq.Parse(rule.SeenKey)
+	if err != nil {
+		return nil, fmt.Errorf("parse seen_key err query=%q err=%w", rule.SeenKey, err)
+	}
+	code, err := gojq.Compile(q, gojq.WithVariables([]string{"$match"}))
+	if err != nil {
+		return nil, fmt.Errorf("compile seen_key err query=%q err=%w", rule.SeenKey, err)
+	}
+
+	f := firstSeen{
+		key:       code,
+		retention: defaultFirstSeenRetention,
+	}
+
+	if rule.Retention != "" {
+		f.retention, err = parseDuration(rule.Retention)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention: %w", err)
+		}
+		if f.retention <= 0 {
+			return nil, fmt.Errorf("retention must be positive but was %q", rule.Retention)
+		}
+	}
+
+	if rule.LearningPeriod != "" {
+		f.learningPeriod, err = parseDuration(rule.LearningPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("invalid learning_period: %w", err)
+		}
+	}
+
+	return &f, nil
+}
+
+// checkFirstSeen records the seen_key value for rec and returns the
+// match object for an alert if the value hasn't been seen before, along
+// with the state store key that marks the value as seen. matches are the
+// rule's match objects for rec. Values seen during the rule's learning
+// period are recorded without alerting.
+func (s *server) checkFirstSeen(lgr log15.Logger, rule *Rule, evtID string, rec map[string]interface{}, matches []interface{}) ([]interface{}, string) {
+	f := rule.firstSeen
+
+	iter := f.key.Run(rec, matches[0])
+	v, ok := iter.Next()
+	if err, isErr := v.(error); isErr {
+		lgr.Error("seen_key_err", "err", err, "rule_name", rule.name, "evt_id", evtID)
+		return nil, ""
+	} else if !ok || v == nil {
+		lgr.Debug("seen_key_no_value", "rule_name", rule.name, "evt_id", evtID)
+		return nil, ""
+	}
+	valJSON, err := json.Marshal(v)
+	if err != nil {
+		lgr.Error("seen_key_encode_err", "err", err, "rule_name", rule.name, "evt_id", evtID)
+		return nil, ""
+	}
+
+	evtTime := eventTime(rec)
+	learning, err := s.firstSeenLearning(rule, evtTime)
+	if err != nil {
+		lgr.Error("first_seen_state_store_err", "err", err, "rule_name", rule.name, "evt_id", evtID)
+		return nil, ""
+	}
+
+	key := "first_seen:" + rule.name + ":" + string(valJSON)
+	isNew, err := s.state.PutIfAbsent(key, nil, f.retention)
+	if err != nil {
+		lgr.Error("first_seen_state_store_err", "err", err, "rule_name", rule.name, "evt_id", evtID)
+		return nil, ""
+	}
+	if !isNew {
+		// extend the retention from the most recent sighting
+		err = s.state.Put(key, nil, f.retention)
+		if err != nil {
+			lgr.Error("first_seen_state_store_err", "err", err, "rule_name", rule.name, "evt_id", evtID)
+		}
+		return nil, ""
+	}
+
+	if learning {
+		lgr.Info("first_seen_learning", "rule_name", rule.name, "evt_id", evtID, "value", string(valJSON))
+		return nil, ""
+	}
+
+	return []interface{}{
+		map[string]interface{}{
+			"value":      v,
+			"first_seen": evtTime.Format(time.RFC3339),
+			"match":      matches[0],
+		},
+	}, key
+}
+
+// firstSeenLearning reports whether evtTime falls within rule's
+// learning period. The learning period starts at the eventTime of the
+// first record the rule matches.
+func (s *server) firstSeenLearning(rule *Rule, evtTime time.Time) (bool, error) {
+	if rule.firstSeen.learningPeriod <= 0 {
+		return false, nil
+	}
+
+	key := "first_seen_start:" + rule.name
+	start, ok, err := s.state.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		start, err = evtTime.MarshalText()
+		if err != nil {
+			return false, err
+		}
+		claimed, err := s.state.PutIfAbsent(key, start, firstSeenStartTTL)
+		if err != nil {
+			return false, err
+		}
+		if !claimed {
+			// another worker started the learning period first
+			start, _, err = s.state.Get(key)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	var startTime time.Time
+	err = startTime.UnmarshalText(start)
+	if err != nil {
+		return false, fmt.Errorf("decode learning period start %q err: %w", start, err)
+	}
+
+	return evtTime.Before(startTime.Add(rule.firstSeen.learningPeriod)), nil
+}
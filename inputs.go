@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/inconshreveable/log15"
+)
+
+// eventProbe is used to figure out what kind of event the lambda
+// function was invoked with.
+type eventProbe struct {
+	Records []struct {
+		EventSource string          `json:"eventSource"`
+		S3          json.RawMessage `json:"s3"`
+	} `json:"Records"`
+
+	// EventBridge events
+	DetailType string `json:"detail-type"`
+
+	// CloudWatch Logs subscription filter events
+	AWSLogs json.RawMessage `json:"awslogs"`
+}
+
+func (p *eventProbe) source() string {
+	if p.DetailType != "" {
+		return "aws:events"
+	}
+	if len(p.AWSLogs) > 0 {
+		return "aws:logs"
+	}
+	if len(p.Records) == 0 {
+		return ""
+	}
+	rec := p.Records[0]
+	if rec.EventSource == "" && len(rec.S3) > 0 {
+		return "aws:s3"
+	}
+	return rec.EventSource
+}
+
+func (s *server) handleEvent(lgr log15.Logger, payload json.RawMessage) (interface{}, error) {
+	var probe eventProbe
+	err := json.Unmarshal(payload, &probe)
+	if err != nil {
+		lgr.Error("decode_event_err", "err", err)
+		return nil, err
+	}
+
+	src := probe.source()
+	switch src {
+	case "aws:s3":
+		var evt events.S3Event
+		err = json.Unmarshal(payload, &evt)
+		if err != nil {
+			lgr.Error("decode_s3_event_err", "err", err)
+			return nil, err
+		}
+		return nil, s.handleS3Event(lgr, evt)
+	case "aws:sqs":
+		var evt events.SQSEvent
+		err = json.Unmarshal(payload, &evt)
+		if err != nil {
+			lgr.Error("decode_sqs_event_err", "err", err)
+			return nil, err
+		}
+		return s.handleSQSEvent(lgr, evt), nil
+	case "aws:sns":
+		var evt events.SNSEvent
+		err = json.Unmarshal(payload, &evt)
+		if err != nil {
+			lgr.Error("decode_sns_event_err", "err", err)
+			return nil, err
+		}
+		return nil, s.handleSNSEvent(lgr, evt)
+	case "aws:events":
+		var evt events.CloudWatchEvent
+		err = json.Unmarshal(payload, &evt)
+		if err != nil {
+			lgr.Error("decode_eventbridge_event_err", "err", err)
+			return nil, err
+		}
+		return nil, s.handleEventBridgeEvent(lgr, evt)
+	case "aws:logs":
+		var evt events.CloudwatchLogsEvent
+		err = json.Unmarshal(payload, &evt)
+		if err != nil {
+			lgr.Error("decode_cloudwatch_logs_event_err", "err", err)
+			return nil, err
+		}
+		data, err := evt.AWSLogs.Parse()
+		if err != nil {
+			lgr.Error("decode_cloudwatch_logs_data_err", "err", err)
+			return nil, err
+		}
+		s.handleCloudwatchLogsData(lgr, data)
+		return nil, nil
+	case "aws:kinesis":
+		var evt events.KinesisEvent
+		err = json.Unmarshal(payload, &evt)
+		if err != nil {
+			lgr.Error("decode_kinesis_event_err", "err", err)
+			return nil, err
+		}
+		return s.handleKinesisEvent(lgr, evt), nil
+	}
+
+	lgr.Error("unsupported_event_type", "event_source", src)
+	return nil, fmt.Errorf("unsupported event type: %q", src)
+}
+
+// handleSQSEvent processes S3 notifications that were delivered via an SQS
+// queue. Messages that fail are reported back as batch item failures so only
+// those messages are retried. This requires ReportBatchItemFailures to be
+// enabled on the event source mapping.
+func (s *server) handleSQSEvent(lgr log15.Logger, evt events.SQSEvent) events.SQSEventResponse {
+	var resp events.SQSEventResponse
+	for _, msg := range evt.Records {
+		mlgr := lgr.New("sqs_message_id", msg.MessageId)
+		err := s.handleS3Notification(mlgr, []byte(msg.Body))
+		if err != nil {
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{
+				ItemIdentifier: msg.MessageId,
+			})
+		}
+	}
+	return resp
+}
+
+// handleSNSEvent processes S3 notifications and CloudTrail log file
+// notifications that were published to an SNS topic.
+func (s *server) handleSNSEvent(lgr log15.Logger, evt events.SNSEvent) error {
+	var firstErr error
+	for _, rec := range evt.Records {
+		mlgr := lgr.New("sns_message_id", rec.SNS.MessageID)
+		err := s.handleS3Notification(mlgr, []byte(rec.SNS.Message))
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// handleEventBridgeEvent evaluates a single CloudTrail event delivered by
+// EventBridge. This has much lower latency than waiting for CloudTrail to
+// deliver log files to S3.
+func (s *server) handleEventBridgeEvent(lgr log15.Logger, evt events.CloudWatchEvent) error {
+	lgr = lgr.New("eventbridge_id", evt.ID, "detail_type", evt.DetailType)
+
+	// "AWS API Call via CloudTrail", "AWS Console Sign In via CloudTrail", etc.
+	if !strings.HasSuffix(evt.DetailType, "via CloudTrail") {
+		lgr.Warn("unsupported_eventbridge_detail_type")
+		return nil
+	}
+
+	var rec map[string]interface{}
+	err := json.Unmarshal(evt.Detail, &rec)
+	if err != nil {
+		lgr.Error("decode_eventbridge_detail_err", "err", err)
+		return err
+	}
+
+	b := s.newBatch(lgr)
+	b.add(rec)
+	b.complete()
+
+	return nil
+}
+
+// handleCloudwatchLogsData evaluates CloudTrail records that were shipped
+// to CloudWatch Logs and delivered by a subscription filter. Log events that
+// are not valid CloudTrail records are logged and skipped since retrying
+// them would not help.
+func (s *server) handleCloudwatchLogsData(lgr log15.Logger, data events.CloudwatchLogsData) {
+	lgr = lgr.New("log_group", data.LogGroup, "log_stream", data.LogStream)
+
+	if data.MessageType == "CONTROL_MESSAGE" {
+		lgr.Info("cloudwatch_logs_control_message")
+		return
+	}
+
+	var errCount int
+	b := s.newBatch(lgr)
+	for _, logEvt := range data.LogEvents {
+		var rec map[string]interface{}
+		err := json.Unmarshal([]byte(logEvt.Message), &rec)
+		if err != nil {
+			lgr.Error("decode_log_event_err", "err", err, "log_event_id", logEvt.ID)
+			errCount++
+			continue
+		}
+
+		b.add(rec)
+	}
+
+	b.complete("decode_err_count", errCount)
+}
+
+// handleKinesisEvent evaluates CloudTrail records read from a Kinesis data
+// stream. Records that fail are reported back as batch item failures so a
+// single bad record doesn't block the shard. This requires
+// ReportBatchItemFailures to be enabled on the event source mapping.
+func (s *server) handleKinesisEvent(lgr log15.Logger, evt events.KinesisEvent) events.KinesisEventResponse {
+	var resp events.KinesisEventResponse
+	for _, rec := range evt.Records {
+		seq := rec.Kinesis.SequenceNumber
+		rlgr := lgr.New("kinesis_seq", seq, "kinesis_partition_key", rec.Kinesis.PartitionKey)
+		err := s.handleKinesisData(rlgr, rec.Kinesis.Data)
+		if err != nil {
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.KinesisBatchItemFailure{
+				ItemIdentifier: seq,
+			})
+		}
+	}
+	return resp
+}
+
+// handleKinesisData handles the data from a single kinesis record. The data
+// is either a gzipped CloudWatch Logs envelope (from a CloudWatch Logs
+// subscription filter destination) or raw JSON. Raw JSON may be a single
+// CloudTrail record or a CloudTrail log document with a Records array.
+func (s *server) handleKinesisData(lgr log15.Logger, data []byte) error {
+	if len(data) > 1 && data[0] == 0x1f && data[1] == 0x8b {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			lgr.Error("new_gz_reader_err", "err", err)
+			return err
+		}
+		defer r.Close()
+
+		var logsData events.CloudwatchLogsData
+		err = json.NewDecoder(r).Decode(&logsData)
+		if err != nil {
+			lgr.Error("decode_cloudwatch_logs_data_err", "err", err)
+			return err
+		}
+
+		s.handleCloudwatchLogsData(lgr, logsData)
+		return nil
+	}
+
+	b := s.newBatch(lgr)
+	_, err := streamRecords(bytes.NewReader(data), b.add)
+	if err != nil {
+		b.wait()
+		lgr.Error("decode_kinesis_data_err", "err", err)
+		return err
+	}
+
+	b.complete()
+
+	return nil
+}
+
+// s3Notification is the union of the notification formats that point
+// at new CloudTrail log files.
+type s3Notification struct {
+	// S3 event notification
+	Records []events.S3EventRecord `json:"Records"`
+
+	// CloudTrail's native SNS notification
+	S3Bucket    string   `json:"s3Bucket"`
+	S3ObjectKey []string `json:"s3ObjectKey"`
+
+	// SNS envelope, for SNS messages delivered to SQS without
+	// raw message delivery enabled
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// handleS3Notification processes a JSON encoded S3 event notification
+// that was delivered by something other than a direct S3 trigger.
+func (s *server) handleS3Notification(lgr log15.Logger, body []byte) error {
+	var n s3Notification
+	err := json.Unmarshal(body, &n)
+	if err != nil {
+		lgr.Error("decode_s3_notification_err", "err", err)
+		return err
+	}
+
+	if n.Type == "Notification" && n.Message != "" {
+		return s.handleS3Notification(lgr, []byte(n.Message))
+	}
+
+	records := n.Records
+	for _, key := range n.S3ObjectKey {
+		var rec events.S3EventRecord
+		rec.S3.Bucket.Name = n.S3Bucket
+		rec.S3.Object.Key = key
+		records = append(records, rec)
+	}
+
+	if len(records) == 0 {
+		// s3:TestEvent messages are sent when a notification is first
+		// configured; they have no records.
+		lgr.Info("s3_notification_no_records")
+		return nil
+	}
+
+	var firstErr error
+	for _, rec := range records {
+		err := s.handleRecord(lgr, rec)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,216 @@
+package destdiscord
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+)
+
+// Discord's embed limits, in characters.
+const (
+	maxDescriptionLen = 4096
+	maxFieldValueLen  = 1024
+	maxEmbedLen       = 6000
+)
+
+// dangerColor is the embed color, matching the Slack "danger" color.
+const dangerColor = 0xE01E5A
+
+var typeName = "discord_webhook"
+
+var client = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+type Loader struct {
+}
+
+func NewLoader() *Loader {
+	return &Loader{}
+}
+
+func (l *Loader) Type() string {
+	return typeName
+}
+
+func (l *Loader) Load(c config.Destination) (destination.Destination, error) {
+	if c.ID == "" {
+		return nil, fmt.Errorf("(discord_webhook) destination.id must be set")
+	}
+	if c.WebhookURL == "" {
+		return nil, fmt.Errorf("(discord_webhook) destination.webhook_url must be set for %q", c.ID)
+	}
+
+	d := DestDiscordWebhook{
+		id:         c.ID,
+		webhookURL: c.WebhookURL,
+	}
+	return &d, nil
+}
+
+type DestDiscordWebhook struct {
+	id         string
+	webhookURL string
+}
+
+func (d *DestDiscordWebhook) ID() string {
+	return d.id
+}
+
+func (d *DestDiscordWebhook) Type() string {
+	return typeName
+}
+
+func (d *DestDiscordWebhook) Send(name, desc string, rec map[string]interface{}, matchObj interface{}) error {
+
+	jsonObj, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal obj err: %w", err)
+	}
+
+	var matchTxt string
+
+	m, ok := matchObj.(map[string]interface{})
+	if !ok || !reflect.DeepEqual(rec, m) {
+		b, err := json.MarshalIndent(matchObj, "", "  ")
+		if err == nil {
+			matchTxt = string(b)
+		}
+	}
+
+	embed := Embed{
+		Title: "Cloudtrail Tattletail Event",
+		Color: dangerColor,
+		Fields: []Field{
+			{
+				Name:   "Alert Name",
+				Value:  truncate(nonEmpty(name), maxFieldValueLen),
+				Inline: true,
+			},
+			{
+				Name:   "Description",
+				Value:  truncate(nonEmpty(desc), maxFieldValueLen),
+				Inline: true,
+			},
+		},
+	}
+
+	if matchTxt != "" {
+		embed.Fields = append(embed.Fields, Field{
+			Name:  "Match",
+			Value: codeBlock(matchTxt, maxFieldValueLen),
+		})
+	}
+
+	// the record gets whatever space is left in the embed
+	remaining := maxEmbedLen - embed.len()
+	if remaining > maxDescriptionLen {
+		remaining = maxDescriptionLen
+	}
+	embed.Description = codeBlock(string(jsonObj), remaining)
+
+	msg := Message{
+		Username: "Cloudtrail Tattletail",
+		Embeds:   []Embed{embed},
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal message err: %w", err)
+	}
+
+	resp, err := client.Post(d.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("discord webhook returned status %d: %s", resp.StatusCode, respBody)
+	}
+
+	return nil
+}
+
+// nonEmpty returns s, or "-" if s is empty. Discord
+// rejects embed fields with empty values.
+func nonEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// codeBlock formats txt as a json code block of at most n characters.
+func codeBlock(txt string, n int) string {
+	const (
+		prefix    = "```json\n"
+		suffix    = "\n```"
+		truncated = "\n..."
+	)
+	if utf8.RuneCountInString(prefix+txt+suffix) <= n {
+		return prefix + txt + suffix
+	}
+	return prefix + truncate(txt, n-len(prefix)-len(suffix)-len(truncated)) + truncated + suffix
+}
+
+// truncate shortens s to at most n characters.
+func truncate(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+func (d *DestDiscordWebhook) String() string {
+	paths := strings.Split(d.webhookURL, "/")
+	if len(paths) > 4 {
+		paths[len(paths)-1] = "**FILTERED**"
+	}
+
+	return fmt.Sprintf("{id: %s webhookURL: %s}", d.id, strings.Join(paths, "/"))
+}
+
+// Message is the payload for a Discord webhook.
+type Message struct {
+	Username string  `json:"username,omitempty"`
+	Content  string  `json:"content,omitempty"`
+	Embeds   []Embed `json:"embeds,omitempty"`
+}
+
+type Embed struct {
+	Title       string  `json:"title,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Color       int     `json:"color,omitempty"`
+	Fields      []Field `json:"fields,omitempty"`
+}
+
+type Field struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"`
+}
+
+// len returns the number of characters that count
+// towards Discord's limit for an embed.
+func (e *Embed) len() int {
+	n := utf8.RuneCountInString(e.Title) + utf8.RuneCountInString(e.Description)
+	for _, f := range e.Fields {
+		n += utf8.RuneCountInString(f.Name) + utf8.RuneCountInString(f.Value)
+	}
+	return n
+}
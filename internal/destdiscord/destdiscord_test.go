@@ -0,0 +1,95 @@
+package destdiscord
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/psanford/cloudtrail-tattletail/config"
+)
+
+func TestSend(t *testing.T) {
+	var got Message
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = Message{}
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	d, err := NewLoader().Load(config.Destination{
+		ID:         "discord",
+		Type:       "discord_webhook",
+		WebhookURL: srv.URL + "/api/webhooks/123/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := map[string]interface{}{
+		"eventID":   "a1b2",
+		"eventName": "CreateUser",
+	}
+	err = d.Send("Create User", "", rec, map[string]interface{}{"user": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.Embeds) != 1 {
+		t.Fatalf("expected 1 embed but got %+v", got)
+	}
+	embed := got.Embeds[0]
+	if len(embed.Fields) != 3 || embed.Fields[0].Value != "Create User" || embed.Fields[1].Value != "-" {
+		t.Fatalf("unexpected fields %+v", embed.Fields)
+	}
+	if embed.Fields[2].Value != "```json\n{\n  \"user\": \"bob\"\n}\n```" {
+		t.Fatalf("unexpected match field %q", embed.Fields[2].Value)
+	}
+	if !strings.Contains(embed.Description, `"eventName": "CreateUser"`) {
+		t.Fatalf("expected record in description but got %q", embed.Description)
+	}
+
+	// large records and matches are truncated to fit discord's limits
+	big := map[string]interface{}{
+		"eventID":  "a1b2",
+		"userData": strings.Repeat("ü", 10000),
+	}
+	err = d.Send(strings.Repeat("name ", 300), strings.Repeat("desc ", 300), big, map[string]interface{}{"big": big})
+	if err != nil {
+		t.Fatal(err)
+	}
+	embed = got.Embeds[0]
+	if n := utf8.RuneCountInString(embed.Description); n > maxDescriptionLen {
+		t.Fatalf("description too long: %d", n)
+	}
+	for _, f := range embed.Fields {
+		if n := utf8.RuneCountInString(f.Value); n > maxFieldValueLen {
+			t.Fatalf("field %s too long: %d", f.Name, n)
+		}
+	}
+	if n := embed.len(); n > maxEmbedLen {
+		t.Fatalf("embed too long: %d", n)
+	}
+	if !strings.HasSuffix(embed.Description, "\n...\n```") {
+		t.Fatalf("expected truncated code block but got %q", embed.Description[len(embed.Description)-20:])
+	}
+}
+
+func TestString(t *testing.T) {
+	d := DestDiscordWebhook{
+		id:         "discord webhook",
+		webhookURL: "https://discord.com/api/webhooks/123456789/XXXX_SENSITIVE_TOKEN_XXXX",
+	}
+
+	actual := d.String()
+	expected := "{id: discord webhook webhookURL: https://discord.com/api/webhooks/123456789/**FILTERED**}"
+	if actual != expected {
+		t.Errorf("expecting %s, got %s", expected, actual)
+	}
+}
@@ -12,3 +12,34 @@ type Destination interface {
 	ID() string
 	Type() string
 }
+
+// SeverityDestination is implemented by destinations that make use of a
+// rule's severity. SendWithSeverity is called in place of Send for
+// these destinations. severity is one of Severities, or empty if the
+// rule doesn't set one.
+type SeverityDestination interface {
+	SendWithSeverity(name, desc, severity string, rec map[string]interface{}, matchObj interface{}) error
+}
+
+// Severities are the valid values for a rule's severity, from most
+// to least severe.
+var Severities = []string{"critical", "error", "warning", "info"}
+
+// ValidSeverity reports whether s is a valid rule severity.
+func ValidSeverity(s string) bool {
+	for _, sev := range Severities {
+		if s == sev {
+			return true
+		}
+	}
+	return false
+}
+
+// Send sends an alert to d, including the severity if d
+// is a SeverityDestination.
+func Send(d Destination, name, desc, severity string, rec map[string]interface{}, matchObj interface{}) error {
+	if sd, ok := d.(SeverityDestination); ok {
+		return sd.SendWithSeverity(name, desc, severity, rec, matchObj)
+	}
+	return d.Send(name, desc, rec, matchObj)
+}
@@ -0,0 +1,151 @@
+package destmattermost
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+	"github.com/slack-go/slack"
+)
+
+// Mattermost incoming webhooks accept the Slack message format. Posts
+// are limited to 16383 characters by default, and that limit applies to
+// the attachment text and fields as well as the message itself. We stay
+// well under it so the rest of the post fits.
+const (
+	maxTextLen  = 12000
+	maxMatchLen = 3000
+	maxFieldLen = 500
+)
+
+var typeName = "mattermost_webhook"
+
+var client = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+type Loader struct {
+}
+
+func NewLoader() *Loader {
+	return &Loader{}
+}
+
+func (l *Loader) Type() string {
+	return typeName
+}
+
+func (l *Loader) Load(c config.Destination) (destination.Destination, error) {
+	if c.ID == "" {
+		return nil, fmt.Errorf("(mattermost_webhook) destination.id must be set")
+	}
+	if c.WebhookURL == "" {
+		return nil, fmt.Errorf("(mattermost_webhook) destination.webhook_url must be set for %q", c.ID)
+	}
+
+	d := DestMattermostWebhook{
+		id:         c.ID,
+		webhookURL: c.WebhookURL,
+	}
+	return &d, nil
+}
+
+type DestMattermostWebhook struct {
+	id         string
+	webhookURL string
+}
+
+func (d *DestMattermostWebhook) ID() string {
+	return d.id
+}
+
+func (d *DestMattermostWebhook) Type() string {
+	return typeName
+}
+
+func (d *DestMattermostWebhook) Send(name, desc string, rec map[string]interface{}, matchObj interface{}) error {
+
+	jsonObj, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal obj err: %w", err)
+	}
+
+	var matchTxt string
+
+	m, ok := matchObj.(map[string]interface{})
+	if !ok || !reflect.DeepEqual(rec, m) {
+		b, err := json.MarshalIndent(matchObj, "", "  ")
+		if err == nil {
+			matchTxt = string(b)
+		}
+	}
+
+	msg := slack.WebhookMessage{
+		IconEmoji: "red_circle",
+		Username:  "Cloudtrail Tattletail",
+		Attachments: []slack.Attachment{
+			{
+				Color: "danger",
+				Title: "Cloudtrail Tattletail Event",
+				Text:  codeBlock(string(jsonObj), maxTextLen),
+				Fields: []slack.AttachmentField{
+					{
+						Title: "Alert Name",
+						Value: truncate(name, maxFieldLen),
+						Short: true,
+					},
+					{
+						Title: "Description",
+						Value: truncate(desc, maxFieldLen),
+						Short: true,
+					},
+				},
+			},
+		},
+	}
+
+	if matchTxt != "" {
+		msg.Attachments[0].Fields = append(msg.Attachments[0].Fields, slack.AttachmentField{
+			Title: "Match",
+			Value: codeBlock(matchTxt, maxMatchLen),
+		})
+	}
+
+	return slack.PostWebhookCustomHTTP(d.webhookURL, client, &msg)
+}
+
+// codeBlock formats txt as a json code block of at most n characters.
+func codeBlock(txt string, n int) string {
+	const (
+		prefix    = "```json\n"
+		suffix    = "\n```"
+		truncated = "\n..."
+	)
+	if utf8.RuneCountInString(prefix+txt+suffix) <= n {
+		return prefix + txt + suffix
+	}
+	return prefix + truncate(txt, n-len(prefix)-len(suffix)-len(truncated)) + truncated + suffix
+}
+
+// truncate shortens s to at most n characters.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+func (d *DestMattermostWebhook) String() string {
+	paths := strings.Split(d.webhookURL, "/")
+	if len(paths) > 4 {
+		paths[len(paths)-1] = "**FILTERED**"
+	}
+
+	return fmt.Sprintf("{id: %s webhookURL: %s}", d.id, strings.Join(paths, "/"))
+}
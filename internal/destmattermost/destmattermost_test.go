@@ -0,0 +1,95 @@
+package destmattermost
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/slack-go/slack"
+)
+
+func TestSend(t *testing.T) {
+	var got slack.WebhookMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = slack.WebhookMessage{}
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	d, err := NewLoader().Load(config.Destination{
+		ID:         "mattermost",
+		Type:       "mattermost_webhook",
+		WebhookURL: srv.URL + "/hooks/xxx",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := map[string]interface{}{
+		"eventID":   "a1b2",
+		"eventName": "CreateUser",
+	}
+	err = d.Send("Create User", "a user was created", rec, map[string]interface{}{"user": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.Attachments) != 1 {
+		t.Fatalf("expected 1 attachment but got %+v", got)
+	}
+	att := got.Attachments[0]
+	if len(att.Fields) != 3 || att.Fields[0].Value != "Create User" || att.Fields[1].Value != "a user was created" {
+		t.Fatalf("unexpected fields %+v", att.Fields)
+	}
+	if att.Fields[2].Value != "```json\n{\n  \"user\": \"bob\"\n}\n```" {
+		t.Fatalf("unexpected match field %q", att.Fields[2].Value)
+	}
+	if !strings.Contains(att.Text, `"eventName": "CreateUser"`) {
+		t.Fatalf("expected record in text but got %q", att.Text)
+	}
+
+	// large records are truncated to fit mattermost's post size limit
+	big := map[string]interface{}{
+		"eventID":  "a1b2",
+		"userData": strings.Repeat("ü", 20000),
+	}
+	err = d.Send("Create User", "", big, map[string]interface{}{"big": big})
+	if err != nil {
+		t.Fatal(err)
+	}
+	att = got.Attachments[0]
+	if n := utf8.RuneCountInString(att.Text); n > maxTextLen {
+		t.Fatalf("text too long: %d", n)
+	}
+	if n := utf8.RuneCountInString(att.Fields[2].Value); n > maxMatchLen {
+		t.Fatalf("match too long: %d", n)
+	}
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	err = d.Send("Create User", "", rec, rec)
+	if err == nil {
+		t.Fatal("expected error for non-2xx response")
+	}
+}
+
+func TestString(t *testing.T) {
+	d := DestMattermostWebhook{
+		id:         "mattermost webhook",
+		webhookURL: "https://mattermost.example.com/hooks/XXXX_SENSITIVE_KEY_XXXX",
+	}
+
+	actual := d.String()
+	expected := "{id: mattermost webhook webhookURL: https://mattermost.example.com/hooks/**FILTERED**}"
+	if actual != expected {
+		t.Errorf("expecting %s, got %s", expected, actual)
+	}
+}
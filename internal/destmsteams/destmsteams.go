@@ -0,0 +1,272 @@
+package destmsteams
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+)
+
+// maxJSONLen limits the size of the match and record JSON in a card.
+// Teams rejects messages larger than about 28KB.
+const maxJSONLen = 10000
+
+// factFields are the record fields shown in the card's FactSet.
+var factFields = []string{
+	"eventName",
+	"userIdentity.arn",
+	"sourceIPAddress",
+	"awsRegion",
+	"eventTime",
+}
+
+var typeName = "msteams_webhook"
+
+var client = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+type Loader struct {
+}
+
+func NewLoader() *Loader {
+	return &Loader{}
+}
+
+func (l *Loader) Type() string {
+	return typeName
+}
+
+func (l *Loader) Load(c config.Destination) (destination.Destination, error) {
+	if c.ID == "" {
+		return nil, fmt.Errorf("(msteams_webhook) destination.id must be set")
+	}
+	if c.WebhookURL == "" {
+		return nil, fmt.Errorf("(msteams_webhook) destination.webhook_url must be set for %q", c.ID)
+	}
+	u, err := url.Parse(c.WebhookURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("(msteams_webhook) destination.webhook_url must be an https url for %q", c.ID)
+	}
+
+	d := DestMSTeamsWebhook{
+		id:         c.ID,
+		webhookURL: u,
+	}
+	return &d, nil
+}
+
+type DestMSTeamsWebhook struct {
+	id         string
+	webhookURL *url.URL
+}
+
+func (d *DestMSTeamsWebhook) ID() string {
+	return d.id
+}
+
+func (d *DestMSTeamsWebhook) Type() string {
+	return typeName
+}
+
+func (d *DestMSTeamsWebhook) Send(name, desc string, rec map[string]interface{}, matchObj interface{}) error {
+	jsonObj, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal obj err: %w", err)
+	}
+
+	var matchTxt string
+
+	m, ok := matchObj.(map[string]interface{})
+	if !ok || !reflect.DeepEqual(rec, m) {
+		b, err := json.MarshalIndent(matchObj, "", "  ")
+		if err == nil {
+			matchTxt = string(b)
+		}
+	}
+
+	var facts []Fact
+	for _, f := range factFields {
+		if v := lookupString(rec, f); v != "" {
+			facts = append(facts, Fact{Title: f, Value: v})
+		}
+	}
+
+	body := []Element{
+		{
+			Type:   "TextBlock",
+			Text:   "Cloudtrail Tattletail Event",
+			Size:   "Medium",
+			Weight: "Bolder",
+			Color:  "Attention",
+		},
+		{
+			Type: "FactSet",
+			Facts: append([]Fact{
+				{Title: "Alert Name", Value: name},
+				{Title: "Description", Value: desc},
+			}, facts...),
+		},
+	}
+
+	if matchTxt != "" {
+		body = append(body,
+			Element{
+				Type:   "TextBlock",
+				Text:   "Match",
+				Weight: "Bolder",
+			},
+			codeBlock(matchTxt),
+		)
+	}
+
+	body = append(body, Element{
+		Type:      "Container",
+		ID:        "record",
+		IsVisible: boolPtr(false),
+		Items:     []Element{codeBlock(string(jsonObj))},
+	})
+
+	msg := Message{
+		Type: "message",
+		Attachments: []Attachment{
+			{
+				ContentType: "application/vnd.microsoft.card.adaptive",
+				Content: AdaptiveCard{
+					Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+					Type:    "AdaptiveCard",
+					Version: "1.4",
+					Body:    body,
+					Actions: []Action{
+						{
+							Type:           "Action.ToggleVisibility",
+							Title:          "Show full event",
+							TargetElements: []string{"record"},
+						},
+					},
+					MSTeams: &MSTeams{Width: "Full"},
+				},
+			},
+		},
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal message err: %w", err)
+	}
+
+	resp, err := client.Post(d.webhookURL.String(), "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("msteams webhook returned status %d: %s", resp.StatusCode, respBody)
+	}
+
+	return nil
+}
+
+// codeBlock returns a monospace TextBlock for txt, truncated to maxJSONLen.
+func codeBlock(txt string) Element {
+	if len(txt) > maxJSONLen {
+		n := maxJSONLen
+		for n > 0 && !utf8.RuneStart(txt[n]) {
+			n--
+		}
+		txt = txt[:n] + "\n...(truncated)"
+	}
+	return Element{
+		Type:     "TextBlock",
+		Text:     txt,
+		FontType: "Monospace",
+		Wrap:     true,
+	}
+}
+
+// lookupString returns the string at the dotted path in rec,
+// or "" if it doesn't exist or isn't a string.
+func lookupString(rec map[string]interface{}, path string) string {
+	var v interface{} = rec
+	for _, p := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = m[p]
+	}
+	s, _ := v.(string)
+	return s
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func (d *DestMSTeamsWebhook) String() string {
+	// the whole path of a teams webhook url is secret
+	return fmt.Sprintf("{id: %s webhookURL: %s://%s/**FILTERED**}", d.id, d.webhookURL.Scheme, d.webhookURL.Host)
+}
+
+// Message is the payload for a Teams incoming webhook.
+type Message struct {
+	Type        string       `json:"type"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+type Attachment struct {
+	ContentType string       `json:"contentType"`
+	Content     AdaptiveCard `json:"content"`
+}
+
+type AdaptiveCard struct {
+	Schema  string    `json:"$schema"`
+	Type    string    `json:"type"`
+	Version string    `json:"version"`
+	Body    []Element `json:"body"`
+	Actions []Action  `json:"actions,omitempty"`
+	MSTeams *MSTeams  `json:"msteams,omitempty"`
+}
+
+type MSTeams struct {
+	Width string `json:"width,omitempty"`
+}
+
+// Element is an Adaptive Card element. Only the fields
+// used by this destination are included.
+type Element struct {
+	Type      string    `json:"type"`
+	ID        string    `json:"id,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	Size      string    `json:"size,omitempty"`
+	Weight    string    `json:"weight,omitempty"`
+	Color     string    `json:"color,omitempty"`
+	FontType  string    `json:"fontType,omitempty"`
+	Wrap      bool      `json:"wrap,omitempty"`
+	IsVisible *bool     `json:"isVisible,omitempty"`
+	Facts     []Fact    `json:"facts,omitempty"`
+	Items     []Element `json:"items,omitempty"`
+}
+
+type Fact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+type Action struct {
+	Type           string   `json:"type"`
+	Title          string   `json:"title"`
+	TargetElements []string `json:"targetElements,omitempty"`
+}
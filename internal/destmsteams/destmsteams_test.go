@@ -0,0 +1,113 @@
+package destmsteams
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/psanford/cloudtrail-tattletail/config"
+)
+
+func TestSend(t *testing.T) {
+	var got Message
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = Message{}
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte("1"))
+	}))
+	defer srv.Close()
+
+	origClient := client
+	client = srv.Client()
+	defer func() { client = origClient }()
+
+	d, err := NewLoader().Load(config.Destination{
+		ID:         "teams",
+		Type:       "msteams_webhook",
+		WebhookURL: srv.URL + "/webhookb2/abc@def/IncomingWebhook/123/456",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := map[string]interface{}{
+		"eventID":         "a1b2",
+		"eventName":       "CreateUser",
+		"awsRegion":       "us-east-1",
+		"sourceIPAddress": "203.0.113.7",
+		"userIdentity": map[string]interface{}{
+			"arn": "arn:aws:iam::123456789:user/alice",
+		},
+	}
+	err = d.Send("Create User", "a user was created", rec, map[string]interface{}{"user": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.Attachments) != 1 || got.Attachments[0].ContentType != "application/vnd.microsoft.card.adaptive" {
+		t.Fatalf("unexpected attachments: %+v", got.Attachments)
+	}
+	card := got.Attachments[0].Content
+	if card.Type != "AdaptiveCard" || len(card.Body) != 5 {
+		t.Fatalf("unexpected card: %+v", card)
+	}
+
+	expectFacts := []Fact{
+		{Title: "Alert Name", Value: "Create User"},
+		{Title: "Description", Value: "a user was created"},
+		{Title: "eventName", Value: "CreateUser"},
+		{Title: "userIdentity.arn", Value: "arn:aws:iam::123456789:user/alice"},
+		{Title: "sourceIPAddress", Value: "203.0.113.7"},
+		{Title: "awsRegion", Value: "us-east-1"},
+	}
+	if !cmp.Equal(card.Body[1].Facts, expectFacts) {
+		t.Fatal(cmp.Diff(card.Body[1].Facts, expectFacts))
+	}
+
+	if card.Body[3].Text != "{\n  \"user\": \"bob\"\n}" {
+		t.Fatalf("unexpected match text: %q", card.Body[3].Text)
+	}
+
+	record := card.Body[4]
+	if record.ID != "record" || record.IsVisible == nil || *record.IsVisible {
+		t.Fatalf("expected hidden record container but got %+v", record)
+	}
+	if !strings.Contains(record.Items[0].Text, `"eventID": "a1b2"`) {
+		t.Fatalf("expected record json but got %q", record.Items[0].Text)
+	}
+	if len(card.Actions) != 1 || card.Actions[0].TargetElements[0] != "record" {
+		t.Fatalf("expected toggle action for record but got %+v", card.Actions)
+	}
+
+	// the match section is omitted when the match is the whole record
+	err = d.Send("Create User", "a user was created", rec, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Attachments[0].Content.Body) != 3 {
+		t.Fatalf("expected no match section but got %+v", got.Attachments[0].Content.Body)
+	}
+}
+
+func TestString(t *testing.T) {
+	d, err := NewLoader().Load(config.Destination{
+		ID:         "teams",
+		Type:       "msteams_webhook",
+		WebhookURL: "https://example.webhook.office.com/webhookb2/XXXX@XXXX/IncomingWebhook/XXXX_SENSITIVE_XXXX/XXXX",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := d.(*DestMSTeamsWebhook).String()
+	expected := "{id: teams webhookURL: https://example.webhook.office.com/**FILTERED**}"
+	if actual != expected {
+		t.Errorf("expecting %s, got %s", expected, actual)
+	}
+}
@@ -0,0 +1,254 @@
+package destopsgenie
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+)
+
+var regionURLs = map[string]string{
+	"us": "https://api.opsgenie.com",
+	"eu": "https://api.eu.opsgenie.com",
+}
+
+// severityPriorities maps rule severities to alert priorities
+// for destinations that don't set a priority.
+var severityPriorities = map[string]string{
+	"critical": "P1",
+	"error":    "P2",
+	"warning":  "P3",
+	"info":     "P5",
+}
+
+const defaultPriority = "P3"
+
+// field length limits of the Alerts API
+const (
+	maxMessageLen     = 130
+	maxAliasLen       = 512
+	maxDescriptionLen = 15000
+)
+
+var typeName = "opsgenie"
+
+var client = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+type Loader struct {
+}
+
+func NewLoader() *Loader {
+	return &Loader{}
+}
+
+func (l *Loader) Type() string {
+	return typeName
+}
+
+func (l *Loader) Load(c config.Destination) (destination.Destination, error) {
+	if c.ID == "" {
+		return nil, fmt.Errorf("(opsgenie) destination.id must be set")
+	}
+	if c.APIKey == "" {
+		return nil, fmt.Errorf("(opsgenie) destination.api_key must be set for %q", c.ID)
+	}
+
+	region := c.Region
+	if region == "" {
+		region = "us"
+	}
+	apiURL := regionURLs[region]
+	if apiURL == "" {
+		return nil, fmt.Errorf("(opsgenie) destination.region must be \"us\" or \"eu\" for %q", c.ID)
+	}
+	if c.APIURL != "" {
+		apiURL = c.APIURL
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("(opsgenie) destination.api_url must be an http or https url for %q", c.ID)
+	}
+
+	switch c.Priority {
+	case "", "P1", "P2", "P3", "P4", "P5":
+	default:
+		return nil, fmt.Errorf("(opsgenie) destination.priority must be one of P1-P5 for %q", c.ID)
+	}
+
+	responders := make([]Responder, 0, len(c.Responders))
+	for _, r := range c.Responders {
+		switch r.Type {
+		case "team", "user", "escalation", "schedule":
+		default:
+			return nil, fmt.Errorf("(opsgenie) destination.responders type must be one of team, user, escalation or schedule for %q", c.ID)
+		}
+		if r.ID == "" && r.Name == "" && r.Username == "" {
+			return nil, fmt.Errorf("(opsgenie) destination.responders must have an id, name or username for %q", c.ID)
+		}
+		responders = append(responders, Responder{
+			Type:     r.Type,
+			ID:       r.ID,
+			Name:     r.Name,
+			Username: r.Username,
+		})
+	}
+
+	d := DestOpsgenie{
+		id:         c.ID,
+		apiKey:     c.APIKey,
+		alertsURL:  strings.TrimSuffix(apiURL, "/") + "/v2/alerts",
+		responders: responders,
+		tags:       c.Tags,
+		priority:   c.Priority,
+	}
+	return &d, nil
+}
+
+type DestOpsgenie struct {
+	id         string
+	apiKey     string
+	alertsURL  string
+	responders []Responder
+	tags       []string
+	priority   string
+}
+
+func (d *DestOpsgenie) ID() string {
+	return d.id
+}
+
+func (d *DestOpsgenie) Type() string {
+	return typeName
+}
+
+func (d *DestOpsgenie) Send(name, desc string, rec map[string]interface{}, matchObj interface{}) error {
+	return d.SendWithSeverity(name, desc, "", rec, matchObj)
+}
+
+func (d *DestOpsgenie) SendWithSeverity(name, desc, severity string, rec map[string]interface{}, matchObj interface{}) error {
+	priority := d.priority
+	if priority == "" {
+		priority = severityPriorities[severity]
+	}
+	if priority == "" {
+		priority = defaultPriority
+	}
+
+	evtID, _ := rec["eventID"].(string)
+
+	recJSON, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal obj err: %w", err)
+	}
+	// the match object comes before the record so that it
+	// survives truncation of long descriptions
+	description := string(recJSON)
+	m, ok := matchObj.(map[string]interface{})
+	if !ok || !reflect.DeepEqual(rec, m) {
+		matchJSON, err := json.MarshalIndent(matchObj, "", "  ")
+		if err == nil {
+			description = "Match:\n" + string(matchJSON) + "\n\nRecord:\n" + description
+		}
+	}
+	if desc != "" {
+		description = desc + "\n\n" + description
+	}
+
+	details := make(map[string]string)
+	for _, f := range []string{"eventID", "eventName", "eventSource", "awsRegion", "sourceIPAddress", "recipientAccountId"} {
+		if v, ok := rec[f].(string); ok {
+			details[f] = v
+		}
+	}
+	if ident, ok := rec["userIdentity"].(map[string]interface{}); ok {
+		if arn, ok := ident["arn"].(string); ok {
+			details["userIdentity.arn"] = arn
+		}
+	}
+
+	alert := Alert{
+		Message:     truncate(name, maxMessageLen),
+		Alias:       truncate(name+":"+evtID, maxAliasLen),
+		Description: truncate(description, maxDescriptionLen),
+		Responders:  d.responders,
+		Tags:        d.tags,
+		Details:     details,
+		Entity:      details["eventSource"],
+		Source:      "cloudtrail-tattletail",
+		Priority:    priority,
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("marshal alert err: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.alertsURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "GenieKey "+d.apiKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("opsgenie alerts api returned status %d: %s", resp.StatusCode, respBody)
+	}
+
+	return nil
+}
+
+// truncate shortens s to at most n bytes without splitting a utf-8
+// encoded rune.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func (d *DestOpsgenie) String() string {
+	return fmt.Sprintf("{id: %s alertsURL: %s apiKey: **FILTERED**}", d.id, d.alertsURL)
+}
+
+// Alert is the request body for creating an alert
+// with the Opsgenie Alerts API.
+type Alert struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Responders  []Responder       `json:"responders,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+	Entity      string            `json:"entity,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	Priority    string            `json:"priority,omitempty"`
+}
+
+type Responder struct {
+	Type     string `json:"type"`
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Username string `json:"username,omitempty"`
+}
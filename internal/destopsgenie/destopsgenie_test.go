@@ -0,0 +1,165 @@
+package destopsgenie
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+)
+
+func TestSend(t *testing.T) {
+	var (
+		gotPath string
+		gotAuth string
+		got     Alert
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		got = Alert{}
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	d, err := NewLoader().Load(config.Destination{
+		ID:     "opsgenie",
+		Type:   "opsgenie",
+		APIKey: "s3cr3t",
+		Region: "eu",
+		APIURL: srv.URL,
+		Responders: []config.Responder{
+			{Type: "team", Name: "SRE"},
+		},
+		Tags: []string{"cloudtrail"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := map[string]interface{}{
+		"eventID":     "a1b2",
+		"eventName":   "ConsoleLogin",
+		"eventSource": "signin.amazonaws.com",
+		"userIdentity": map[string]interface{}{
+			"type": "Root",
+			"arn":  "arn:aws:iam::123456789:root",
+		},
+	}
+	err = destination.Send(d, "Root Login", "the root account logged in", "critical", rec, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotPath != "/v2/alerts" {
+		t.Fatalf("unexpected path %q", gotPath)
+	}
+	if gotAuth != "GenieKey s3cr3t" {
+		t.Fatalf("unexpected authorization header %q", gotAuth)
+	}
+
+	if !strings.HasPrefix(got.Description, "the root account logged in\n\n{") {
+		t.Fatalf("unexpected description %q", got.Description)
+	}
+	got.Description = ""
+
+	expect := Alert{
+		Message:    "Root Login",
+		Alias:      "Root Login:a1b2",
+		Responders: []Responder{{Type: "team", Name: "SRE"}},
+		Tags:       []string{"cloudtrail"},
+		Details: map[string]string{
+			"eventID":          "a1b2",
+			"eventName":        "ConsoleLogin",
+			"eventSource":      "signin.amazonaws.com",
+			"userIdentity.arn": "arn:aws:iam::123456789:root",
+		},
+		Entity:   "signin.amazonaws.com",
+		Source:   "cloudtrail-tattletail",
+		Priority: "P1",
+	}
+	if !cmp.Equal(got, expect) {
+		t.Fatal(cmp.Diff(got, expect))
+	}
+
+	// a configured priority takes precedence over the rule's severity
+	d, err = NewLoader().Load(config.Destination{
+		ID:       "opsgenie",
+		Type:     "opsgenie",
+		APIKey:   "s3cr3t",
+		APIURL:   srv.URL,
+		Priority: "P4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = destination.Send(d, strings.Repeat("long name ", 20), "", "critical", rec, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Priority != "P4" {
+		t.Fatalf("expected priority P4 but got %q", got.Priority)
+	}
+	if len(got.Message) != maxMessageLen {
+		t.Fatalf("expected message to be truncated to %d but was %d", maxMessageLen, len(got.Message))
+	}
+
+	// a match object that isn't the record is included in the description
+	err = d.Send("Root Login", "", rec, map[string]interface{}{"count": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got.Description, "Match:\n{\n  \"count\": 3\n}\n\nRecord:\n{") {
+		t.Fatalf("unexpected description %q", got.Description)
+	}
+}
+
+func TestLoadRegion(t *testing.T) {
+	d, err := NewLoader().Load(config.Destination{
+		ID:     "opsgenie",
+		Type:   "opsgenie",
+		APIKey: "s3cr3t",
+		Region: "eu",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.(*DestOpsgenie).alertsURL != "https://api.eu.opsgenie.com/v2/alerts" {
+		t.Fatalf("unexpected alerts url %q", d.(*DestOpsgenie).alertsURL)
+	}
+
+	_, err = NewLoader().Load(config.Destination{
+		ID:     "opsgenie",
+		Type:   "opsgenie",
+		APIKey: "s3cr3t",
+		Region: "mars",
+	})
+	if err == nil {
+		t.Fatal("expected error for invalid region")
+	}
+}
+
+func TestString(t *testing.T) {
+	d, err := NewLoader().Load(config.Destination{
+		ID:     "opsgenie",
+		Type:   "opsgenie",
+		APIKey: "s3cr3t",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := d.(*DestOpsgenie).String()
+	expected := "{id: opsgenie alertsURL: https://api.opsgenie.com/v2/alerts apiKey: **FILTERED**}"
+	if actual != expected {
+		t.Errorf("expecting %s, got %s", expected, actual)
+	}
+}
@@ -0,0 +1,190 @@
+package destpagerduty
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+)
+
+const (
+	defaultAPIURL   = "https://events.pagerduty.com"
+	defaultSeverity = "error"
+
+	// maxSummaryLen is the longest summary the Events API accepts.
+	maxSummaryLen = 1024
+)
+
+var typeName = "pagerduty"
+
+var client = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+type Loader struct {
+}
+
+func NewLoader() *Loader {
+	return &Loader{}
+}
+
+func (l *Loader) Type() string {
+	return typeName
+}
+
+func (l *Loader) Load(c config.Destination) (destination.Destination, error) {
+	if c.ID == "" {
+		return nil, fmt.Errorf("(pagerduty) destination.id must be set")
+	}
+	if c.RoutingKey == "" {
+		return nil, fmt.Errorf("(pagerduty) destination.routing_key must be set for %q", c.ID)
+	}
+
+	apiURL := c.APIURL
+	if apiURL == "" {
+		apiURL = defaultAPIURL
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("(pagerduty) destination.api_url must be an http or https url for %q", c.ID)
+	}
+
+	d := DestPagerDuty{
+		id:         c.ID,
+		routingKey: c.RoutingKey,
+		eventsURL:  strings.TrimSuffix(apiURL, "/") + "/v2/enqueue",
+	}
+	return &d, nil
+}
+
+type DestPagerDuty struct {
+	id         string
+	routingKey string
+	eventsURL  string
+}
+
+func (d *DestPagerDuty) ID() string {
+	return d.id
+}
+
+func (d *DestPagerDuty) Type() string {
+	return typeName
+}
+
+func (d *DestPagerDuty) Send(name, desc string, rec map[string]interface{}, matchObj interface{}) error {
+	return d.SendWithSeverity(name, desc, "", rec, matchObj)
+}
+
+func (d *DestPagerDuty) SendWithSeverity(name, desc, severity string, rec map[string]interface{}, matchObj interface{}) error {
+	if severity == "" {
+		severity = defaultSeverity
+	}
+
+	summary := name
+	if desc != "" {
+		summary += ": " + desc
+	}
+	if len(summary) > maxSummaryLen {
+		summary = truncate(summary, maxSummaryLen-3) + "..."
+	}
+
+	source, _ := rec["eventSource"].(string)
+	if source == "" {
+		source = "cloudtrail-tattletail"
+	}
+
+	// the custom details are the record, plus the match object
+	// (e.g. the output of jq_transform) when it isn't the whole record
+	details := rec
+	if m, ok := matchObj.(map[string]interface{}); matchObj != nil && (!ok || !reflect.DeepEqual(rec, m)) {
+		details = make(map[string]interface{}, len(rec)+1)
+		for k, v := range rec {
+			details[k] = v
+		}
+		details["match"] = matchObj
+	}
+
+	evt := Event{
+		RoutingKey:  d.routingKey,
+		EventAction: "trigger",
+		Payload: Payload{
+			Summary:       summary,
+			Source:        source,
+			Severity:      severity,
+			Class:         stringField(rec, "eventName"),
+			Group:         stringField(rec, "recipientAccountId"),
+			CustomDetails: details,
+		},
+	}
+	evt.DedupKey, _ = rec["eventID"].(string)
+	if ts, ok := rec["eventTime"].(string); ok {
+		evt.Payload.Timestamp = ts
+	}
+
+	body, err := json.Marshal(evt)
+	if err != nil {
+		return fmt.Errorf("marshal event err: %w", err)
+	}
+
+	resp, err := client.Post(d.eventsURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("pagerduty events api returned status %d: %s", resp.StatusCode, respBody)
+	}
+
+	return nil
+}
+
+// truncate shortens s to at most n bytes without splitting a utf-8
+// encoded rune.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func stringField(rec map[string]interface{}, key string) string {
+	s, _ := rec[key].(string)
+	return s
+}
+
+func (d *DestPagerDuty) String() string {
+	return fmt.Sprintf("{id: %s eventsURL: %s routingKey: **FILTERED**}", d.id, d.eventsURL)
+}
+
+// Event is a PagerDuty Events API v2 event.
+type Event struct {
+	RoutingKey  string  `json:"routing_key"`
+	EventAction string  `json:"event_action"`
+	DedupKey    string  `json:"dedup_key,omitempty"`
+	Payload     Payload `json:"payload"`
+}
+
+type Payload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Timestamp     string                 `json:"timestamp,omitempty"`
+	Class         string                 `json:"class,omitempty"`
+	Group         string                 `json:"group,omitempty"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
@@ -0,0 +1,148 @@
+package destpagerduty
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+)
+
+func TestSend(t *testing.T) {
+	var (
+		gotPath string
+		got     Event
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	d, err := NewLoader().Load(config.Destination{
+		ID:         "oncall",
+		Type:       "pagerduty",
+		RoutingKey: "R0UT1NGK3Y",
+		APIURL:     srv.URL + "/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := map[string]interface{}{
+		"eventID":            "a1b2",
+		"eventName":          "StopLogging",
+		"eventSource":        "cloudtrail.amazonaws.com",
+		"eventTime":          "2021-07-13T15:40:00Z",
+		"recipientAccountId": "123456789",
+	}
+	err = destination.Send(d, "CloudTrail Stopped", "logging was disabled", "critical", rec, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := Event{
+		RoutingKey:  "R0UT1NGK3Y",
+		EventAction: "trigger",
+		DedupKey:    "a1b2",
+		Payload: Payload{
+			Summary:       "CloudTrail Stopped: logging was disabled",
+			Source:        "cloudtrail.amazonaws.com",
+			Severity:      "critical",
+			Timestamp:     "2021-07-13T15:40:00Z",
+			Class:         "StopLogging",
+			Group:         "123456789",
+			CustomDetails: rec,
+		},
+	}
+	if gotPath != "/v2/enqueue" {
+		t.Fatalf("unexpected path %q", gotPath)
+	}
+	if !cmp.Equal(got, expect) {
+		t.Fatal(cmp.Diff(got, expect))
+	}
+
+	// rules without a severity use the default
+	err = d.Send("CloudTrail Stopped", "", rec, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Payload.Severity != defaultSeverity {
+		t.Fatalf("expected default severity but got %q", got.Payload.Severity)
+	}
+
+	// a match object that isn't the record is included
+	// alongside it, and long summaries are truncated
+	// without splitting multi-byte characters
+	got = Event{}
+	err = d.Send(strings.Repeat("é", maxSummaryLen), "", rec, map[string]interface{}{"user": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utf8.ValidString(got.Payload.Summary) || len(got.Payload.Summary) > maxSummaryLen {
+		t.Fatalf("invalid truncated summary %q", got.Payload.Summary)
+	}
+	expectDetails := map[string]interface{}{
+		"eventID":            "a1b2",
+		"eventName":          "StopLogging",
+		"eventSource":        "cloudtrail.amazonaws.com",
+		"eventTime":          "2021-07-13T15:40:00Z",
+		"recipientAccountId": "123456789",
+		"match":              map[string]interface{}{"user": "bob"},
+	}
+	if !cmp.Equal(got.Payload.CustomDetails, expectDetails) {
+		t.Fatal(cmp.Diff(got.Payload.CustomDetails, expectDetails))
+	}
+	if _, ok := rec["match"]; ok {
+		t.Fatal("expected the record to not be modified")
+	}
+}
+
+func TestSendErr(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"invalid event","message":"Event object is invalid"}`))
+	}))
+	defer srv.Close()
+
+	d, err := NewLoader().Load(config.Destination{
+		ID:         "oncall",
+		Type:       "pagerduty",
+		RoutingKey: "R0UT1NGK3Y",
+		APIURL:     srv.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.Send("CloudTrail Stopped", "", map[string]interface{}{}, nil)
+	if err == nil {
+		t.Fatal("expected error for non-2xx response")
+	}
+}
+
+func TestString(t *testing.T) {
+	d, err := NewLoader().Load(config.Destination{
+		ID:         "oncall",
+		Type:       "pagerduty",
+		RoutingKey: "R0UT1NGK3Y",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := d.(*DestPagerDuty).String()
+	expected := "{id: oncall eventsURL: https://events.pagerduty.com/v2/enqueue routingKey: **FILTERED**}"
+	if actual != expected {
+		t.Errorf("expecting %s, got %s", expected, actual)
+	}
+}
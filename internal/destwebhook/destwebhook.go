@@ -0,0 +1,186 @@
+package destwebhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+)
+
+const (
+	// SignatureHeader holds the hex encoded HMAC-SHA256 of the
+	// timestamp, a '.', and the request body, prefixed with "sha256=".
+	SignatureHeader = "X-Tattletail-Signature"
+	// TimestampHeader holds the unix time the request was signed.
+	TimestampHeader = "X-Tattletail-Timestamp"
+)
+
+// defaultBodyTemplate sends the alert as a JSON object.
+const defaultBodyTemplate = `{"name":{{json .Name}},"description":{{json .Description}},"record":{{json .Record}},"match":{{json .Match}}}`
+
+var typeName = "webhook"
+
+var client = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// now is overridden in tests
+var now = time.Now
+
+type Loader struct {
+}
+
+func NewLoader() *Loader {
+	return &Loader{}
+}
+
+func (l *Loader) Type() string {
+	return typeName
+}
+
+func (l *Loader) Load(c config.Destination) (destination.Destination, error) {
+	if c.ID == "" {
+		return nil, fmt.Errorf("(webhook) destination.id must be set")
+	}
+	if c.WebhookURL == "" {
+		return nil, fmt.Errorf("(webhook) destination.webhook_url must be set for %q", c.ID)
+	}
+	u, err := url.Parse(c.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("(webhook) destination.webhook_url must be an http or https url for %q", c.ID)
+	}
+
+	method := c.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	body := c.BodyTemplate
+	if body == "" {
+		body = defaultBodyTemplate
+	}
+	tmpl, err := template.New(c.ID).Funcs(templateFuncs).Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("(webhook) destination.body_template parse err for %q: %w", c.ID, err)
+	}
+
+	d := DestWebhook{
+		id:         c.ID,
+		url:        u,
+		method:     method,
+		headers:    c.Headers,
+		body:       tmpl,
+		hmacSecret: c.HMACSecret,
+	}
+	return &d, nil
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+type DestWebhook struct {
+	id         string
+	url        *url.URL
+	method     string
+	headers    map[string]string
+	body       *template.Template
+	hmacSecret string
+}
+
+// TemplateData is the data available to body templates.
+type TemplateData struct {
+	Name        string
+	Description string
+	EventID     string
+	Record      map[string]interface{}
+	Match       interface{}
+}
+
+func (d *DestWebhook) ID() string {
+	return d.id
+}
+
+func (d *DestWebhook) Type() string {
+	return typeName
+}
+
+func (d *DestWebhook) Send(name, desc string, rec map[string]interface{}, matchObj interface{}) error {
+	data := TemplateData{
+		Name:        name,
+		Description: desc,
+		Record:      rec,
+		Match:       matchObj,
+	}
+	data.EventID, _ = rec["eventID"].(string)
+
+	var body bytes.Buffer
+	err := d.body.Execute(&body, data)
+	if err != nil {
+		return fmt.Errorf("render body_template err: %w", err)
+	}
+
+	req, err := http.NewRequest(d.method, d.url.String(), bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cloudtrail-tattletail")
+	for k, v := range d.headers {
+		req.Header.Set(k, v)
+	}
+
+	if d.hmacSecret != "" {
+		ts := strconv.FormatInt(now().Unix(), 10)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(SignatureHeader, "sha256="+Sign(d.hmacSecret, ts, body.Bytes()))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook %s returned status %d: %s", d, resp.StatusCode, respBody)
+	}
+
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature for a request body
+// sent at timestamp ts. Receivers can use it to verify requests.
+func Sign(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *DestWebhook) String() string {
+	// paths and query strings often contain secrets
+	u := d.url.Scheme + "://" + d.url.Host
+	if d.url.Path != "" && d.url.Path != "/" || d.url.RawQuery != "" {
+		u += "/**FILTERED**"
+	}
+
+	return fmt.Sprintf("{id: %s webhookURL: %s}", d.id, u)
+}
@@ -0,0 +1,143 @@
+package destwebhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/psanford/cloudtrail-tattletail/config"
+)
+
+func TestSend(t *testing.T) {
+	now = func() time.Time { return time.Unix(1626188400, 0) }
+	defer func() { now = time.Now }()
+
+	type request struct {
+		method string
+		header http.Header
+		body   string
+	}
+	var got []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got = append(got, request{
+			method: r.Method,
+			header: r.Header,
+			body:   string(body),
+		})
+		if r.Header.Get("X-Fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	rec := map[string]interface{}{
+		"eventID":   "a1b2",
+		"eventName": "CreateUser",
+	}
+
+	l := NewLoader()
+	d, err := l.Load(config.Destination{
+		ID:         "default",
+		Type:       "webhook",
+		WebhookURL: srv.URL + "/hook",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Send("Create User", "a user was created", rec, map[string]interface{}{"user": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectBody := `{"name":"Create User","description":"a user was created","record":{"eventID":"a1b2","eventName":"CreateUser"},"match":{"user":"bob"}}`
+	if got[0].method != "POST" || got[0].body != expectBody {
+		t.Fatalf("unexpected request method=%s body=%s", got[0].method, got[0].body)
+	}
+	if got[0].header.Get(SignatureHeader) != "" {
+		t.Fatalf("expected unsigned request")
+	}
+
+	d, err = l.Load(config.Destination{
+		ID:         "custom",
+		Type:       "webhook",
+		WebhookURL: srv.URL + "/tickets?token=secret",
+		Method:     "PUT",
+		Headers: map[string]string{
+			"Content-Type":  "text/plain",
+			"Authorization": "Bearer abc",
+		},
+		BodyTemplate: `{{.Name}}: {{.Record.eventName}} ({{.EventID}})`,
+		HMACSecret:   "shh",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Send("Create User", "", rec, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := got[1]
+	if r.method != "PUT" || r.body != "Create User: CreateUser (a1b2)" {
+		t.Fatalf("unexpected request method=%s body=%s", r.method, r.body)
+	}
+	if r.header.Get("Content-Type") != "text/plain" || r.header.Get("Authorization") != "Bearer abc" {
+		t.Fatalf("missing custom headers: %v", r.header)
+	}
+	if r.header.Get(TimestampHeader) != "1626188400" {
+		t.Fatalf("unexpected timestamp header %q", r.header.Get(TimestampHeader))
+	}
+	expectSig := "sha256=" + Sign("shh", "1626188400", []byte(r.body))
+	if r.header.Get(SignatureHeader) != expectSig {
+		t.Fatalf("signature mismatch got %q expected %q", r.header.Get(SignatureHeader), expectSig)
+	}
+
+	d, err = l.Load(config.Destination{
+		ID:         "failing",
+		Type:       "webhook",
+		WebhookURL: srv.URL,
+		Headers:    map[string]string{"X-Fail": "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Send("Create User", "", rec, rec)
+	if err == nil {
+		t.Fatal("expected error for non-2xx response")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	l := NewLoader()
+
+	_, err := l.Load(config.Destination{ID: "no url", Type: "webhook"})
+	if err == nil {
+		t.Fatal("expected error for missing webhook_url")
+	}
+
+	_, err = l.Load(config.Destination{ID: "bad template", Type: "webhook", WebhookURL: "https://example.com", BodyTemplate: "{{.Name"})
+	if err == nil {
+		t.Fatal("expected error for invalid body_template")
+	}
+}
+
+func TestString(t *testing.T) {
+	d, err := NewLoader().Load(config.Destination{
+		ID:         "tickets",
+		Type:       "webhook",
+		WebhookURL: "https://tickets.example.com/api/hooks/XXXX_SENSITIVE_XXXX?token=secret",
+		HMACSecret: "shh",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := d.(*DestWebhook).String()
+	expected := "{id: tickets webhookURL: https://tickets.example.com/**FILTERED**}"
+	if actual != expected {
+		t.Errorf("expecting %s, got %s", expected, actual)
+	}
+}
@@ -0,0 +1,150 @@
+package statestore
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/cloudtrail-tattletail/awsstub"
+)
+
+// DynamoDB is a Store backed by a DynamoDB table. The table must have a
+// string partition key named "key". Items have an "expires_at" attribute
+// (unix seconds) which can be configured as the table's TTL attribute so
+// that DynamoDB cleans up expired items.
+type DynamoDB struct {
+	table string
+}
+
+func NewDynamoDB(table string) *DynamoDB {
+	return &DynamoDB{
+		table: table,
+	}
+}
+
+const (
+	keyAttr     = "key"
+	valAttr     = "val"
+	expiresAttr = "expires_at"
+)
+
+func (d *DynamoDB) Get(key string) ([]byte, bool, error) {
+	out, err := awsstub.DynamoDBGetItem(&dynamodb.GetItemInput{
+		TableName:      &d.table,
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			keyAttr: {S: &key},
+		},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if out.Item == nil {
+		return nil, false, nil
+	}
+
+	// DynamoDB TTL deletion can lag by up to a few days
+	// so we need to check the expiration ourselves.
+	if exp := out.Item[expiresAttr]; exp == nil || exp.N == nil {
+		return nil, false, nil
+	} else if expiresAt, err := strconv.ParseInt(*exp.N, 10, 64); err != nil || expiresAt <= now().Unix() {
+		return nil, false, nil
+	}
+
+	var val []byte
+	if v := out.Item[valAttr]; v != nil {
+		val = v.B
+	}
+
+	return val, true, nil
+}
+
+func (d *DynamoDB) Put(key string, val []byte, ttl time.Duration) error {
+	_, err := awsstub.DynamoDBPutItem(&dynamodb.PutItemInput{
+		TableName: &d.table,
+		Item:      d.item(key, val, ttl),
+	})
+	return err
+}
+
+func (d *DynamoDB) PutIfAbsent(key string, val []byte, ttl time.Duration) (bool, error) {
+	_, err := awsstub.DynamoDBPutItem(&dynamodb.PutItemInput{
+		TableName:           &d.table,
+		Item:                d.item(key, val, ttl),
+		ConditionExpression: aws.String("attribute_not_exists(#k) OR #e <= :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#k": aws.String(keyAttr),
+			"#e": aws.String(expiresAttr),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(now().Unix(), 10))},
+		},
+	})
+	return conditionalPut(err)
+}
+
+func (d *DynamoDB) CompareAndSwap(key string, old, val []byte, ttl time.Duration) (bool, error) {
+	if old == nil {
+		return d.PutIfAbsent(key, val, ttl)
+	}
+
+	input := dynamodb.PutItemInput{
+		TableName:           &d.table,
+		Item:                d.item(key, val, ttl),
+		ConditionExpression: aws.String("#v = :old AND #e > :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#v": aws.String(valAttr),
+			"#e": aws.String(expiresAttr),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":old": {B: old},
+			":now": {N: aws.String(strconv.FormatInt(now().Unix(), 10))},
+		},
+	}
+	if len(old) == 0 {
+		// empty values are stored without a val attribute
+		input.ConditionExpression = aws.String("attribute_not_exists(#v) AND #e > :now")
+		delete(input.ExpressionAttributeValues, ":old")
+	}
+
+	_, err := awsstub.DynamoDBPutItem(&input)
+	return conditionalPut(err)
+}
+
+func (d *DynamoDB) Delete(key string) error {
+	_, err := awsstub.DynamoDBDeleteItem(&dynamodb.DeleteItemInput{
+		TableName: &d.table,
+		Key: map[string]*dynamodb.AttributeValue{
+			keyAttr: {S: &key},
+		},
+	})
+	return err
+}
+
+// conditionalPut converts the result of a conditional PutItem
+// into whether the item was written.
+func conditionalPut(err error) (bool, error) {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *DynamoDB) item(key string, val []byte, ttl time.Duration) map[string]*dynamodb.AttributeValue {
+	// round up so that short ttls don't expire immediately
+	expiresAt := now().Add(ttl + time.Second - 1).Unix()
+	item := map[string]*dynamodb.AttributeValue{
+		keyAttr:     {S: aws.String(key)},
+		expiresAttr: {N: aws.String(strconv.FormatInt(expiresAt, 10))},
+	}
+	if len(val) > 0 {
+		item[valAttr] = &dynamodb.AttributeValue{B: val}
+	}
+	return item
+}
@@ -0,0 +1,156 @@
+package statestore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// File is a Store that persists state to a local JSON file. It is
+// intended for local use (e.g. carrying first_seen or sequence state
+// across replay runs) rather than lambda. Writes are kept in memory
+// until Flush is called.
+type File struct {
+	path string
+
+	mu    sync.Mutex
+	items map[string]item
+	dirty bool
+}
+
+// NewFile returns a File store backed by path. Existing state is
+// loaded from path if it exists.
+func NewFile(path string) (*File, error) {
+	f := File{
+		path:  path,
+		items: make(map[string]item),
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &f, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &f.items)
+	if err != nil {
+		return nil, fmt.Errorf("decode state file %s err: %w", path, err)
+	}
+
+	return &f, nil
+}
+
+func (f *File) Get(key string) ([]byte, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	it, ok := f.items[key]
+	if !ok || !now().Before(it.Expires) {
+		return nil, false, nil
+	}
+	return it.Val, true, nil
+}
+
+func (f *File) Put(key string, val []byte, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.items[key] = item{
+		Val:     val,
+		Expires: now().Add(ttl),
+	}
+	f.dirty = true
+	return nil
+}
+
+func (f *File) PutIfAbsent(key string, val []byte, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := now()
+	if it, ok := f.items[key]; ok && t.Before(it.Expires) {
+		return false, nil
+	}
+	f.items[key] = item{
+		Val:     val,
+		Expires: t.Add(ttl),
+	}
+	f.dirty = true
+	return true, nil
+}
+
+func (f *File) CompareAndSwap(key string, old, val []byte, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := now()
+	it, ok := f.items[key]
+	exists := ok && t.Before(it.Expires)
+	if old == nil && exists || old != nil && (!exists || !bytes.Equal(it.Val, old)) {
+		return false, nil
+	}
+	f.items[key] = item{
+		Val:     val,
+		Expires: t.Add(ttl),
+	}
+	f.dirty = true
+	return true, nil
+}
+
+func (f *File) Delete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.items, key)
+	f.dirty = true
+	return nil
+}
+
+// Flush writes all unexpired items to the state file if there
+// have been any changes since the last Flush.
+func (f *File) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.dirty {
+		return nil
+	}
+
+	removeExpired(f.items, now())
+
+	b, err := json.Marshal(f.items)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), ".statestore")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), f.path)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	f.dirty = false
+	return nil
+}
@@ -0,0 +1,117 @@
+package statestore
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// Memory is a Store that keeps state in memory. State survives
+// across invocations of a warm lambda function but is lost when
+// the function is cold started.
+type Memory struct {
+	mu     sync.Mutex
+	items  map[string]item
+	writes int
+}
+
+type item struct {
+	Val     []byte    `json:"val"`
+	Expires time.Time `json:"expires"`
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		items: make(map[string]item),
+	}
+}
+
+func (m *Memory) Get(key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	it, ok := m.items[key]
+	if !ok || !now().Before(it.Expires) {
+		return nil, false, nil
+	}
+	return it.Val, true, nil
+}
+
+func (m *Memory) Put(key string, val []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := now()
+	m.items[key] = item{
+		Val:     val,
+		Expires: t.Add(ttl),
+	}
+	m.wrote(t)
+	return nil
+}
+
+func (m *Memory) PutIfAbsent(key string, val []byte, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := now()
+	if it, ok := m.items[key]; ok && t.Before(it.Expires) {
+		return false, nil
+	}
+	m.items[key] = item{
+		Val:     val,
+		Expires: t.Add(ttl),
+	}
+	m.wrote(t)
+	return true, nil
+}
+
+func (m *Memory) CompareAndSwap(key string, old, val []byte, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := now()
+	it, ok := m.items[key]
+	exists := ok && t.Before(it.Expires)
+	if old == nil && exists || old != nil && (!exists || !bytes.Equal(it.Val, old)) {
+		return false, nil
+	}
+	m.items[key] = item{
+		Val:     val,
+		Expires: t.Add(ttl),
+	}
+	m.wrote(t)
+	return true, nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.items, key)
+	return nil
+}
+
+// sweepInterval is the number of writes between sweeps
+// for expired items.
+const sweepInterval = 1000
+
+// wrote counts a write and removes expired items every
+// sweepInterval writes. m.mu must be held.
+func (m *Memory) wrote(t time.Time) {
+	m.writes++
+	if m.writes < sweepInterval {
+		return
+	}
+	m.writes = 0
+	removeExpired(m.items, t)
+}
+
+// removeExpired deletes the items that have expired as of t.
+func removeExpired(items map[string]item, t time.Time) {
+	for k, it := range items {
+		if !t.Before(it.Expires) {
+			delete(items, k)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Package statestore provides key/value stores used to keep state
+// (such as alerts that have already been sent) across records and
+// lambda invocations.
+package statestore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/psanford/cloudtrail-tattletail/config"
+)
+
+// Store is a key/value store where every key expires after a ttl.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the value for key. ok is false if the key does not
+	// exist or has expired.
+	Get(key string) (val []byte, ok bool, err error)
+	// Put sets key to val. The key expires after ttl.
+	Put(key string, val []byte, ttl time.Duration) error
+	// PutIfAbsent sets key to val only if key does not exist or has
+	// expired. It reports whether the value was set.
+	PutIfAbsent(key string, val []byte, ttl time.Duration) (bool, error)
+	// CompareAndSwap sets key to val only if its current value is old.
+	// A nil old means the key must not exist or has expired. It reports
+	// whether the value was set.
+	CompareAndSwap(key string, old, val []byte, ttl time.Duration) (bool, error)
+	// Delete removes key.
+	Delete(key string) error
+}
+
+// Flusher is implemented by stores that buffer writes. Flush persists
+// any buffered writes.
+type Flusher interface {
+	Flush() error
+}
+
+// New returns the store described by c. An empty type returns
+// a memory store.
+func New(c config.StateStore) (Store, error) {
+	switch c.Type {
+	case "", "memory":
+		return NewMemory(), nil
+	case "file":
+		if c.Path == "" {
+			return nil, fmt.Errorf("(file) state_store.path must be set")
+		}
+		return NewFile(c.Path)
+	case "dynamodb":
+		if c.DynamoDBTable == "" {
+			return nil, fmt.Errorf("(dynamodb) state_store.dynamodb_table must be set")
+		}
+		return NewDynamoDB(c.DynamoDBTable), nil
+	}
+
+	return nil, fmt.Errorf("invalid state_store type %q", c.Type)
+}
+
+// maxUpdateAttempts bounds how many times Update retries
+// after losing a race with a concurrent writer.
+const maxUpdateAttempts = 10
+
+// Update atomically replaces the value of key with the result of fn. fn
+// is called with the current value (nil if key does not exist) and may
+// be called more than once if there are concurrent writers. If fn returns
+// an error the value is left unchanged. Update returns the value that
+// was stored.
+func Update(s Store, key string, ttl time.Duration, fn func(old []byte) ([]byte, error)) ([]byte, error) {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		old, ok, err := s.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			old = nil
+		}
+
+		val, err := fn(old)
+		if err != nil {
+			return nil, err
+		}
+
+		set, err := s.CompareAndSwap(key, old, val, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if set {
+			return val, nil
+		}
+	}
+
+	return nil, fmt.Errorf("update %q: too many concurrent writers", key)
+}
+
+// now is overridden in tests
+var now = time.Now
@@ -0,0 +1,280 @@
+package statestore
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/cloudtrail-tattletail/awsstub"
+)
+
+func TestStores(t *testing.T) {
+	fake := newFakeDynamoDB()
+	awsstub.DynamoDBGetItem = fake.GetItem
+	awsstub.DynamoDBPutItem = fake.PutItem
+	awsstub.DynamoDBDeleteItem = fake.DeleteItem
+
+	fileStore, err := NewFile(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]Store{
+		"memory":   NewMemory(),
+		"file":     fileStore,
+		"dynamodb": NewDynamoDB("tattletail-state"),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testStore(t, store)
+		})
+	}
+}
+
+func testStore(t *testing.T, store Store) {
+	clock := time.Date(2021, 7, 10, 16, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	_, ok, err := store.Get("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected missing key to not exist")
+	}
+
+	err = store.Put("a", []byte("hello"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, ok, err := store.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(val) != "hello" {
+		t.Fatalf("expected hello but got ok=%t val=%q", ok, val)
+	}
+
+	set, err := store.PutIfAbsent("a", []byte("other"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set {
+		t.Fatal("expected PutIfAbsent to not overwrite an existing key")
+	}
+
+	set, err = store.PutIfAbsent("b", nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set {
+		t.Fatal("expected PutIfAbsent to set a new key")
+	}
+	_, ok, err = store.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected key with no value to exist")
+	}
+
+	clock = clock.Add(2 * time.Minute)
+
+	_, ok, err = store.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected key to have expired")
+	}
+
+	set, err = store.PutIfAbsent("a", []byte("again"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set {
+		t.Fatal("expected PutIfAbsent to replace an expired key")
+	}
+
+	set, err = store.CompareAndSwap("a", []byte("wrong"), []byte("swapped"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set {
+		t.Fatal("expected CompareAndSwap with the wrong old value to fail")
+	}
+	set, err = store.CompareAndSwap("a", []byte("again"), []byte("swapped"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set {
+		t.Fatal("expected CompareAndSwap with the current value to succeed")
+	}
+	set, err = store.CompareAndSwap("c", nil, []byte("new"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set {
+		t.Fatal("expected CompareAndSwap with nil old to set a new key")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := Update(store, "counter", time.Minute, func(old []byte) ([]byte, error) {
+				var n int
+				if old != nil {
+					n, _ = strconv.Atoi(string(old))
+				}
+				return []byte(fmt.Sprint(n + 1)), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	val, _, err = store.Get("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "5" {
+		t.Fatalf("expected counter to be 5 but got %q", val)
+	}
+
+	err = store.Delete("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err = store.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected deleted key to not exist")
+	}
+}
+
+func TestFilePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Put("a", []byte("hello"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f2, err := NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, ok, err := f2.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(val) != "hello" {
+		t.Fatalf("expected hello but got ok=%t val=%q", ok, val)
+	}
+}
+
+func TestMemorySweepsExpired(t *testing.T) {
+	clock := time.Date(2021, 7, 10, 16, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	m := NewMemory()
+	for i := 0; i < sweepInterval-1; i++ {
+		err := m.Put(fmt.Sprintf("old-%d", i), nil, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock = clock.Add(time.Hour)
+	err := m.Put("new", nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.items) != 1 {
+		t.Fatalf("expected expired items to be removed but have %d items", len(m.items))
+	}
+}
+
+// fakeDynamoDB implements just enough of DynamoDB for the DynamoDB store.
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{
+		items: make(map[string]map[string]*dynamodb.AttributeValue),
+	}
+}
+
+func (f *fakeDynamoDB) GetItem(i *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &dynamodb.GetItemOutput{
+		Item: f.items[*i.Key[keyAttr].S],
+	}, nil
+}
+
+func (f *fakeDynamoDB) PutItem(i *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := *i.Item[keyAttr].S
+	if i.ConditionExpression != nil {
+		existing := f.items[key]
+		var live bool
+		if existing != nil {
+			expiresAt, _ := strconv.ParseInt(*existing[expiresAttr].N, 10, 64)
+			nowUnix, _ := strconv.ParseInt(*i.ExpressionAttributeValues[":now"].N, 10, 64)
+			live = expiresAt > nowUnix
+		}
+
+		var pass bool
+		switch *i.ConditionExpression {
+		case "attribute_not_exists(#k) OR #e <= :now":
+			pass = !live
+		case "#v = :old AND #e > :now":
+			pass = live && existing[valAttr] != nil && bytes.Equal(existing[valAttr].B, i.ExpressionAttributeValues[":old"].B)
+		case "attribute_not_exists(#v) AND #e > :now":
+			pass = live && existing[valAttr] == nil
+		default:
+			panic("unexpected condition expression: " + *i.ConditionExpression)
+		}
+		if !pass {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+		}
+	}
+
+	f.items[key] = i.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItem(i *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.items, *i.Key[keyAttr].S)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
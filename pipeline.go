@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+	"github.com/psanford/cloudtrail-tattletail/internal/statestore"
+)
+
+const defaultDeliveryWorkers = 8
+
+// batch evaluates a group of records (usually a single CloudTrail log
+// file). Records are evaluated by a bounded pool of rule workers and
+// matches are handed to an async delivery queue so that slow destinations
+// don't hold up rule evaluation.
+type batch struct {
+	s   *server
+	lgr log15.Logger
+
+	records    chan map[string]interface{}
+	deliveries chan delivery
+
+	evalWG    sync.WaitGroup
+	deliverWG sync.WaitGroup
+
+	recordCount      int64
+	matchCount       int64
+	deliveryErrCount int64
+	// suppressHits counts the records dropped by each of
+	// the server's suppressions
+	suppressHits []int64
+}
+
+// alert is a single rule match that is being delivered to
+// the rule's destinations.
+type alert struct {
+	rule  *Rule
+	evtID string
+	rec   map[string]interface{}
+	// match is the rule's match object and payload is what is sent
+	// to destinations (the output of jq_transform, if the rule has one)
+	match   interface{}
+	payload interface{}
+
+	// dedupKey is the state store key claimed for this alert, if any
+	dedupKey string
+	// seenKey is the state store key that marked a first_seen
+	// rule's value as seen, if any
+	seenKey string
+
+	pending int32
+	failed  int32
+}
+
+// matchDestination is implemented by destinations that report the
+// rule's match object as well as the payload, such as the dry run
+// destination used by local commands.
+type matchDestination interface {
+	SendMatch(name string, rec map[string]interface{}, matchObj, payload interface{}) error
+}
+
+type delivery struct {
+	dest  destination.Destination
+	alert *alert
+}
+
+func (s *server) newBatch(lgr log15.Logger) *batch {
+	ruleWorkers := s.ruleWorkers
+	if ruleWorkers < 1 {
+		ruleWorkers = runtime.NumCPU()
+	}
+	deliveryWorkers := s.deliveryWorkers
+	if deliveryWorkers < 1 {
+		deliveryWorkers = defaultDeliveryWorkers
+	}
+
+	b := batch{
+		s:            s,
+		lgr:          lgr,
+		records:      make(chan map[string]interface{}),
+		deliveries:   make(chan delivery),
+		suppressHits: make([]int64, len(s.suppressions)),
+	}
+
+	b.evalWG.Add(ruleWorkers)
+	for i := 0; i < ruleWorkers; i++ {
+		go func() {
+			defer b.evalWG.Done()
+			for rec := range b.records {
+				b.evalRecord(rec)
+			}
+		}()
+	}
+
+	b.deliverWG.Add(deliveryWorkers)
+	for i := 0; i < deliveryWorkers; i++ {
+		go func() {
+			defer b.deliverWG.Done()
+			for d := range b.deliveries {
+				b.deliver(d)
+			}
+		}()
+	}
+
+	return &b
+}
+
+// add queues rec for evaluation. It blocks while all rule workers are busy.
+func (b *batch) add(rec map[string]interface{}) {
+	b.recordCount++
+	b.records <- rec
+}
+
+// wait blocks until every record has been evaluated and every delivery
+// has either finished or failed, then flushes the state store if it
+// buffers writes. No records may be added after wait is called.
+func (b *batch) wait() {
+	close(b.records)
+	b.evalWG.Wait()
+	close(b.deliveries)
+	b.deliverWG.Wait()
+
+	if f, ok := b.s.state.(statestore.Flusher); ok {
+		err := f.Flush()
+		if err != nil {
+			b.lgr.Error("flush_state_store_err", "err", err)
+		}
+	}
+}
+
+// complete waits for all work in the batch to finish and logs the
+// processing_complete summary, along with any additional ctx.
+func (b *batch) complete(ctx ...interface{}) {
+	b.wait()
+	ctx = append([]interface{}{
+		"record_count", b.recordCount,
+		"match_count", atomic.LoadInt64(&b.matchCount),
+		"delivery_err_count", atomic.LoadInt64(&b.deliveryErrCount),
+	}, ctx...)
+
+	if len(b.suppressHits) > 0 {
+		var (
+			total int64
+			hits  = make([]string, len(b.suppressHits))
+		)
+		for i, n := range b.suppressHits {
+			total += n
+			hits[i] = fmt.Sprintf("%s:%d", b.s.suppressions[i].name, n)
+		}
+		ctx = append(ctx, "suppressed_count", total, "suppress_hits", strings.Join(hits, ","))
+	}
+
+	b.lgr.Info("processing_complete", ctx...)
+}
+
+// evalRecord runs every rule against a single cloudtrail record and
+// queues any matches for delivery to the rule's destinations.
+func (b *batch) evalRecord(rec map[string]interface{}) {
+	lgr := b.lgr
+
+	var evtID string
+	idI, ok := rec["eventID"]
+	if ok {
+		evtID, _ = idI.(string)
+	}
+
+	now := time.Now()
+	for i, sup := range b.s.suppressions {
+		if !sup.expired(now) && sup.matches(lgr, rec) {
+			atomic.AddInt64(&b.suppressHits[i], 1)
+			lgr.Debug("record_suppressed", "suppress_name", sup.name, "evt_id", evtID, "reason", sup.reason)
+			return
+		}
+	}
+
+	// jq queries never change rec's contents, but gojq's Code.Run writes
+	// every value of its input back in place while normalizing numbers.
+	// Destinations read rec concurrently, so alerts are only queued for
+	// delivery once every rule's queries have run against rec.
+	var alerts []*alert
+	for i := range b.s.rules {
+		rule := &b.s.rules[i]
+		matches := rule.Matches(lgr, rec)
+		if len(matches) == 0 {
+			continue
+		}
+		if e := firstMatch(lgr, rule.exceptions, rec); e != nil {
+			lgr.Info("rule_match_suppressed", "rule_name", rule.name, "evt_id", evtID, "reason", e.reason)
+			continue
+		}
+		var seenKey string
+		if rule.threshold != nil {
+			matches = b.s.countThreshold(lgr, rule, evtID, rec, matches)
+		} else if rule.firstSeen != nil {
+			matches, seenKey = b.s.checkFirstSeen(lgr, rule, evtID, rec, matches)
+		} else if rule.sequence != nil {
+			matches = b.s.advanceSequence(lgr, rule, evtID, rec)
+		}
+		for _, obj := range matches {
+			atomic.AddInt64(&b.matchCount, 1)
+			lgr.Info("rule_matched", "rule_name", rule.name, "evt_id", evtID)
+
+			a := alert{
+				rule:    rule,
+				evtID:   evtID,
+				rec:     rec,
+				match:   obj,
+				payload: rule.Transform(lgr, rec, obj),
+				seenKey: seenKey,
+			}
+
+			if rule.dedupTTL > 0 {
+				key, dup := b.s.claimAlert(lgr, rule, evtID, rec, obj)
+				if dup {
+					lgr.Info("alert_deduplicated", "rule_name", rule.name, "evt_id", evtID, "dedup_key", key)
+					continue
+				}
+				a.dedupKey = key
+			}
+
+			alerts = append(alerts, &a)
+		}
+	}
+
+	for _, a := range alerts {
+		b.send(a)
+	}
+}
+
+// send queues a for delivery to each of its rule's destinations.
+func (b *batch) send(a *alert) {
+	a.pending = int32(len(a.rule.dests))
+	for _, dest := range a.rule.dests {
+		b.deliveries <- delivery{
+			dest:  dest,
+			alert: a,
+		}
+	}
+}
+
+func (b *batch) deliver(d delivery) {
+	a := d.alert
+	b.lgr.Info("publish_alert", "dest", d.dest, "rule_name", a.rule.name, "evt_id", a.evtID)
+	var err error
+	if md, ok := d.dest.(matchDestination); ok {
+		err = md.SendMatch(a.rule.name, a.rec, a.match, a.payload)
+	} else {
+		err = destination.Send(d.dest, a.rule.name, a.rule.desc, a.rule.severity, a.rec, a.payload)
+	}
+	if err != nil {
+		atomic.AddInt64(&b.deliveryErrCount, 1)
+		atomic.AddInt32(&a.failed, 1)
+		b.lgr.Error("publish_alert_err", "err", err, "type", d.dest.Type(), "rule_name", a.rule.name, "evt_id", a.evtID)
+	}
+
+	if atomic.AddInt32(&a.pending, -1) == 0 && atomic.LoadInt32(&a.failed) == int32(len(a.rule.dests)) {
+		// the alert didn't make it anywhere; release its dedup and
+		// seen keys so that a retry can send it
+		if a.dedupKey != "" {
+			err := b.s.state.Delete(a.dedupKey)
+			if err != nil {
+				b.lgr.Error("release_dedup_key_err", "err", err, "dedup_key", a.dedupKey)
+			}
+		}
+		if a.seenKey != "" {
+			err := b.s.state.Delete(a.seenKey)
+			if err != nil {
+				b.lgr.Error("release_seen_key_err", "err", err, "seen_key", a.seenKey)
+			}
+		}
+	}
+}
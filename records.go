@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// streamRecords decodes CloudTrail records from r and calls fn for each
+// one as it is read. r may contain a CloudTrail log document (an object with
+// a Records array), a single record, or a stream of either (such as JSONL or
+// the output of `jq '.Records[]'`). Only one record is held in memory at a
+// time, so peak memory is bounded by the largest record rather than the size
+// of the input. It returns the number of records decoded.
+func streamRecords(r io.Reader, fn func(rec map[string]interface{})) (int, error) {
+	dec := json.NewDecoder(r)
+
+	var count int
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+		if d, ok := tok.(json.Delim); !ok || d != '{' {
+			return count, fmt.Errorf("expected '{' but got %v", tok)
+		}
+
+		var (
+			isDoc bool
+			rec   = make(map[string]interface{})
+		)
+
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return count, err
+			}
+			key, _ := tok.(string)
+
+			switch {
+			case strings.EqualFold(key, "records"):
+				isDoc = true
+				var n int
+				n, err = streamArray(dec, fn)
+				count += n
+			case isDoc:
+				err = skipValue(dec)
+			default:
+				var v interface{}
+				err = dec.Decode(&v)
+				rec[key] = v
+			}
+			if err != nil {
+				return count, err
+			}
+		}
+
+		err = expectDelim(dec, '}')
+		if err != nil {
+			return count, err
+		}
+
+		if !isDoc && len(rec) > 0 {
+			count++
+			fn(rec)
+		}
+	}
+}
+
+// streamArray decodes a Records array, calling fn for each record.
+func streamArray(dec *json.Decoder, fn func(rec map[string]interface{})) (int, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+	if tok == nil {
+		// "Records": null
+		return 0, nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return 0, fmt.Errorf("expected Records to be an array but got %v", tok)
+	}
+
+	var count int
+	for dec.More() {
+		var rec map[string]interface{}
+		err = dec.Decode(&rec)
+		if err != nil {
+			return count, err
+		}
+		count++
+		if rec != nil {
+			fn(rec)
+		}
+	}
+
+	return count, expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expected %q but got %v", want, tok)
+	}
+	return nil
+}
+
+// skipValue discards the next JSON value from dec without buffering it.
+func skipValue(dec *json.Decoder) error {
+	var depth int
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// eventTime returns the time rec's event happened, or the current
+// time if the record doesn't have a valid eventTime.
+func eventTime(rec map[string]interface{}) time.Time {
+	if ts, ok := rec["eventTime"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, ts); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/cloudtrail-tattletail/awsstub"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+)
+
+func replayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	confPath := flags.String("config", "tattletail.toml", "Path to config file")
+	bucket := flags.String("bucket", "", "CloudTrail S3 bucket (required)")
+	prefix := flags.String("prefix", "AWSLogs/", "Key prefix up to the account id (e.g. AWSLogs/o-exampleorgid/ for organization trails)")
+	accounts := flags.String("account", "", "Comma separated account ids (default all)")
+	regions := flags.String("region", "", "Comma separated regions (default all)")
+	start := flags.String("start", "", "First day to replay, YYYY-MM-DD (required)")
+	end := flags.String("end", "", "Last day to replay, YYYY-MM-DD (default today)")
+	destID := flags.String("dest", "", "Send matches to this destination id (default: don't send)")
+	verbose := flags.Bool("v", false, "Verbose logging")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s replay -bucket <bucket> -start YYYY-MM-DD [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Runs rules against historical CloudTrail logs in S3 and reports match counts per rule.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *bucket == "" || *start == "" {
+		flags.Usage()
+		return 2
+	}
+
+	opts := replayOptions{
+		bucket:   *bucket,
+		prefix:   *prefix,
+		accounts: splitList(*accounts),
+		regions:  splitList(*regions),
+		destID:   *destID,
+	}
+
+	var err error
+	opts.start, err = time.Parse("2006-01-02", *start)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -start: %s\n", err)
+		return 2
+	}
+	opts.end = time.Now().UTC()
+	if *end != "" {
+		opts.end, err = time.Parse("2006-01-02", *end)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -end: %s\n", err)
+			return 2
+		}
+	}
+
+	lgr := cliLogger(*verbose)
+	awsstub.InitAWS()
+
+	s := newServer()
+	err = s.loadLocalConfig(lgr, *confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load config err: %s\n", err)
+		return 1
+	}
+
+	result, err := s.replay(lgr, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay err: %s\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stdout, "files=%d file_errors=%d\n", result.fileCount, result.fileErrCount)
+	for _, rule := range s.rules {
+		fmt.Fprintf(os.Stdout, "rule=%q matches=%d\n", rule.name, result.matches[rule.name])
+	}
+
+	if result.fileErrCount > 0 {
+		return 1
+	}
+	return 0
+}
+
+type replayOptions struct {
+	bucket string
+	// prefix is everything before the account id, usually "AWSLogs/"
+	prefix   string
+	accounts []string
+	regions  []string
+	start    time.Time
+	end      time.Time
+	// destID is the destination that matches are sent to. If empty
+	// matches are only counted.
+	destID string
+}
+
+type replayResult struct {
+	fileCount    int
+	fileErrCount int
+	// matches is the number of alerts per rule name
+	matches map[string]int
+}
+
+// replay runs the server's rules against the CloudTrail log files in S3
+// for the given accounts, regions and date range. Alerts are not sent to the
+// rules' destinations; they are counted and optionally sent to opts.destID.
+func (s *server) replay(lgr log15.Logger, opts replayOptions) (*replayResult, error) {
+	dest := &replayDest{
+		counts: make(map[string]int),
+	}
+	if opts.destID != "" {
+		dest.dest = s.destinations[opts.destID]
+		if dest.dest == nil {
+			return nil, fmt.Errorf("unknown destination %q", opts.destID)
+		}
+	}
+	s.replaceDestinations(dest)
+
+	prefix := opts.prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	accounts := opts.accounts
+	if len(accounts) == 0 {
+		var err error
+		accounts, err = listSubdirs(opts.bucket, prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := replayResult{
+		matches: dest.counts,
+	}
+
+	for _, acct := range accounts {
+		acctPrefix := prefix + acct + "/CloudTrail/"
+		regions := opts.regions
+		if len(regions) == 0 {
+			var err error
+			regions, err = listSubdirs(opts.bucket, acctPrefix)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, region := range regions {
+			for day := opts.start; !day.After(opts.end); day = day.AddDate(0, 0, 1) {
+				dayPrefix := acctPrefix + region + "/" + day.Format("2006/01/02/")
+				err := awsstub.S3ListObjsV2Pages(&s3.ListObjectsV2Input{
+					Bucket: aws.String(opts.bucket),
+					Prefix: aws.String(dayPrefix),
+				}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+					for _, obj := range page.Contents {
+						var rec events.S3EventRecord
+						rec.S3.Bucket.Name = opts.bucket
+						rec.S3.Object.Key = aws.StringValue(obj.Key)
+
+						result.fileCount++
+						err := s.handleRecord(lgr, rec)
+						if err != nil {
+							result.fileErrCount++
+						}
+					}
+					return true
+				})
+				if err != nil {
+					lgr.Error("list_objects_err", "err", err, "prefix", dayPrefix)
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return &result, nil
+}
+
+// listSubdirs returns the names of the "directories" directly under prefix.
+func listSubdirs(bucket, prefix string) ([]string, error) {
+	var dirs []string
+	err := awsstub.S3ListObjsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			dir := strings.TrimPrefix(aws.StringValue(p.Prefix), prefix)
+			dirs = append(dirs, strings.TrimSuffix(dir, "/"))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %s err: %w", prefix, err)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// replayDest counts alerts per rule and optionally forwards them
+// to another destination.
+type replayDest struct {
+	dest destination.Destination
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (d *replayDest) ID() string {
+	return "replay"
+}
+
+func (d *replayDest) Type() string {
+	return "replay"
+}
+
+func (d *replayDest) Send(name, desc string, rec map[string]interface{}, matchObj interface{}) error {
+	return d.SendWithSeverity(name, desc, "", rec, matchObj)
+}
+
+func (d *replayDest) SendWithSeverity(name, desc, severity string, rec map[string]interface{}, matchObj interface{}) error {
+	d.mu.Lock()
+	d.counts[name]++
+	d.mu.Unlock()
+
+	if d.dest == nil {
+		return nil
+	}
+	return destination.Send(d.dest, name, desc, severity, rec, matchObj)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/BurntSushi/toml"
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/cloudtrail-tattletail/config"
+)
+
+func testRulesCommand(args []string) int {
+	flags := flag.NewFlagSet("test-rules", flag.ExitOnError)
+	confPath := flags.String("config", "tattletail.toml", "Path to config file")
+	verbose := flags.Bool("v", false, "Verbose logging")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s test-rules [-config tattletail.toml]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Runs the [[rule.test]] fixtures in the config file.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	lgr := cliLogger(*verbose)
+
+	s := newServer()
+	err := s.loadLocalConfig(lgr, *confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load config err: %s\n", err)
+		return 1
+	}
+
+	var conf config.Config
+	_, err = toml.DecodeFile(*confPath, &conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load config err: %s\n", err)
+		return 1
+	}
+
+	results := s.runRuleTests(lgr, conf, filepath.Dir(*confPath))
+
+	var failed int
+	for _, res := range results {
+		fmt.Fprintln(os.Stdout, res)
+		if res.err != nil {
+			failed++
+		}
+	}
+	fmt.Fprintf(os.Stdout, "%d passed, %d failed\n", len(results)-failed, failed)
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+type ruleTestResult struct {
+	rule string
+	test string
+	err  error
+}
+
+func (r ruleTestResult) String() string {
+	if r.err != nil {
+		return fmt.Sprintf("FAIL rule=%q test=%q: %s", r.rule, r.test, r.err)
+	}
+	return fmt.Sprintf("PASS rule=%q test=%q", r.rule, r.test)
+}
+
+// runRuleTests runs the test fixtures defined in conf against the server's
+// loaded rules. conf must be the config the rules were loaded from. Relative
+// record_file paths are resolved against baseDir.
+func (s *server) runRuleTests(lgr log15.Logger, conf config.Config, baseDir string) []ruleTestResult {
+	var results []ruleTestResult
+	for i, confRule := range conf.Rules {
+		rule := &s.rules[i]
+		for j, test := range confRule.Tests {
+			name := test.Name
+			if name == "" {
+				name = fmt.Sprintf("test %d", j)
+			}
+			results = append(results, ruleTestResult{
+				rule: rule.name,
+				test: name,
+				err:  rule.runTest(lgr, test, baseDir),
+			})
+		}
+	}
+	return results
+}
+
+func (r *Rule) runTest(lgr log15.Logger, test config.RuleTest, baseDir string) error {
+	if r.sequence != nil {
+		// a single record can't complete a sequence
+		return fmt.Errorf("tests are not supported for sequence rules")
+	}
+
+	rec, err := loadTestRecord(test, baseDir)
+	if err != nil {
+		return err
+	}
+
+	matches := r.Matches(lgr, rec)
+	if firstMatch(lgr, r.exceptions, rec) != nil {
+		matches = nil
+	}
+	matched := len(matches) > 0
+
+	if matched != test.ExpectMatch {
+		return fmt.Errorf("expected match=%t but got match=%t", test.ExpectMatch, matched)
+	}
+
+	if !matched || test.ExpectMatchObject == "" {
+		return nil
+	}
+
+	var expect interface{}
+	err = json.Unmarshal([]byte(test.ExpectMatchObject), &expect)
+	if err != nil {
+		return fmt.Errorf("decode expect_match_object err: %w", err)
+	}
+
+	var got interface{} = matches
+	if len(matches) == 1 {
+		got = matches[0]
+	}
+
+	// round trip through json so numbers etc. compare the same way
+	gotJSON, err := json.Marshal(got)
+	if err != nil {
+		return fmt.Errorf("marshal match object err: %w", err)
+	}
+	var gotNormalized interface{}
+	err = json.Unmarshal(gotJSON, &gotNormalized)
+	if err != nil {
+		return fmt.Errorf("decode match object err: %w", err)
+	}
+
+	if !reflect.DeepEqual(gotNormalized, expect) {
+		return fmt.Errorf("match object mismatch:\n  expected: %s\n  got:      %s", test.ExpectMatchObject, gotJSON)
+	}
+
+	return nil
+}
+
+func loadTestRecord(test config.RuleTest, baseDir string) (map[string]interface{}, error) {
+	if (test.Record == "") == (test.RecordFile == "") {
+		return nil, fmt.Errorf("exactly one of record or record_file must be set")
+	}
+
+	if test.Record != "" {
+		var rec map[string]interface{}
+		err := json.Unmarshal([]byte(test.Record), &rec)
+		if err != nil {
+			return nil, fmt.Errorf("decode record err: %w", err)
+		}
+		return rec, nil
+	}
+
+	fname := test.RecordFile
+	if !filepath.IsAbs(fname) {
+		fname = filepath.Join(baseDir, fname)
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := maybeGunzip(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return selectRecord(r, test.EventID)
+}
+
+// selectRecord returns the record with the given eventID from r. If eventID
+// is empty r must contain exactly one record.
+func selectRecord(r io.Reader, eventID string) (map[string]interface{}, error) {
+	var found []map[string]interface{}
+	_, err := streamRecords(r, func(rec map[string]interface{}) {
+		if eventID == "" || rec["eventID"] == eventID {
+			found = append(found, rec)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode record_file err: %w", err)
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no record found with event_id=%q", eventID)
+	}
+	if eventID == "" && len(found) > 1 {
+		return nil, fmt.Errorf("record_file contains %d records; set event_id to select one", len(found))
+	}
+
+	return found[0], nil
+}
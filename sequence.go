@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/itchyny/gojq"
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/statestore"
+)
+
+// maxSequenceCandidates is the number of records kept for each
+// step of a partial sequence.
+const maxSequenceCandidates = 5
+
+// maxSequenceRecordLen limits the encoded size of each record kept in
+// a partial sequence so that the whole partial sequence fits in a single
+// state store item (DynamoDB items are limited to 400KB). Larger records
+// are trimmed to sequenceRecordFields.
+const maxSequenceRecordLen = 4096
+
+// sequenceRecordFields are the fields kept when a record is trimmed.
+var sequenceRecordFields = []string{
+	"eventID",
+	"eventTime",
+	"eventName",
+	"eventSource",
+	"awsRegion",
+	"sourceIPAddress",
+	"userAgent",
+	"userIdentity",
+	"recipientAccountId",
+	"errorCode",
+}
+
+// sequence holds the settings for rules with type "sequence".
+type sequence struct {
+	steps  []sequenceStep
+	window time.Duration
+}
+
+type sequenceStep struct {
+	name    string
+	query   *gojq.Code
+	joinKey *gojq.Code
+}
+
+func newSequence(rule config.Rule) (*sequence, error) {
+	if len(rule.Steps) < 2 {
+		return nil, errors.New("at least 2 steps are required")
+	}
+	if rule.Window == "" {
+		return nil, errors.New("window must be set")
+	}
+	window, err := parseDuration(rule.Window)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window: %w", err)
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("window must be positive but was %q", rule.Window)
+	}
+
+	compileJoinKey := func(query string) (*gojq.Code, error) {
+		q, err := gojq.Parse(query)
+		if err != nil {
+			return nil, fmt.Errorf("parse join_key err query=%q err=%w", query, err)
+		}
+		code, err := gojq.Compile(q, gojq.WithVariables([]string{"$match"}))
+		if err != nil {
+			return nil, fmt.Errorf("compile join_key err query=%q err=%w", query, err)
+		}
+		return code, nil
+	}
+
+	var joinKey *gojq.Code
+	if rule.JoinKey != "" {
+		joinKey, err = compileJoinKey(rule.JoinKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seq := sequence{
+		window: window,
+	}
+	for i, cs := range rule.Steps {
+		step := sequenceStep{
+			name:    cs.Name,
+			joinKey: joinKey,
+		}
+		if step.name == "" {
+			step.name = fmt.Sprintf("step_%d", i)
+		}
+
+		if cs.JQMatch == "" {
+			return nil, fmt.Errorf("jq_match not defined for step name=%q idx=%d", cs.Name, i)
+		}
+		q, err := gojq.Parse(cs.JQMatch)
+		if err != nil {
+			return nil, fmt.Errorf("parse jq_match err for step name=%q idx=%d query=%q err=%w", cs.Name, i, cs.JQMatch, err)
+		}
+		step.query, err = gojq.Compile(q)
+		if err != nil {
+			return nil, fmt.Errorf("compile jq_match err for step name=%q idx=%d query=%q err=%w", cs.Name, i, cs.JQMatch, err)
+		}
+
+		if cs.JoinKey != "" {
+			step.joinKey, err = compileJoinKey(cs.JoinKey)
+			if err != nil {
+				return nil, fmt.Errorf("step name=%q idx=%d: %w", cs.Name, i, err)
+			}
+		}
+
+		seq.steps = append(seq.steps, step)
+	}
+
+	return &seq, nil
+}
+
+// sequenceState is the partial sequence kept for each join key.
+type sequenceState struct {
+	// Steps has the most recent records that matched each step,
+	// ordered by eventTime.
+	Steps [][]sequenceEntry `json:"steps"`
+}
+
+type sequenceEntry struct {
+	EventID   string                 `json:"event_id"`
+	EventTime time.Time              `json:"event_time"`
+	Record    map[string]interface{} `json:"record"`
+	// Truncated is set if Record was trimmed to sequenceRecordFields.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// newSequenceEntry returns the entry for rec to store in a partial
+// sequence, trimming rec if it is larger than maxSequenceRecordLen.
+func newSequenceEntry(evtID string, evtTime time.Time, rec map[string]interface{}) sequenceEntry {
+	e := sequenceEntry{
+		EventID:   evtID,
+		EventTime: evtTime,
+		Record:    rec,
+	}
+
+	b, err := json.Marshal(rec)
+	if err == nil && len(b) <= maxSequenceRecordLen {
+		return e
+	}
+
+	e.Record = make(map[string]interface{})
+	for _, f := range sequenceRecordFields {
+		if v, ok := rec[f]; ok {
+			e.Record[f] = v
+		}
+	}
+	e.Truncated = true
+	return e
+}
+
+// advanceSequence adds rec to the partial sequences for each step it
+// matches and returns a match object for every sequence it completes. A
+// sequence is complete when there are records for every step, in eventTime
+// order, within the rule's window. Completed sequences are cleared so that
+// each one only alerts once.
+func (s *server) advanceSequence(lgr log15.Logger, rule *Rule, evtID string, rec map[string]interface{}) []interface{} {
+	var (
+		order     []string
+		keyVals   = make(map[string]interface{})
+		keySteps  = make(map[string][]int)
+		seq       = rule.sequence
+		evtTime   = eventTime(rec)
+		newEntry  = newSequenceEntry(evtID, evtTime, rec)
+		matchObjs []interface{}
+	)
+
+	for i, step := range seq.steps {
+		match, obj := matchQuery(lgr, rule.name, step.query, rec)
+		if !match {
+			continue
+		}
+
+		var key interface{}
+		if step.joinKey != nil {
+			iter := step.joinKey.Run(rec, obj)
+			v, ok := iter.Next()
+			if err, isErr := v.(error); isErr {
+				lgr.Error("join_key_err", "err", err, "rule_name", rule.name, "step", step.name, "evt_id", evtID)
+				continue
+			} else if !ok || v == nil {
+				lgr.Debug("join_key_no_value", "rule_name", rule.name, "step", step.name, "evt_id", evtID)
+				continue
+			}
+			key = v
+		}
+		keyJSON, err := json.Marshal(key)
+		if err != nil {
+			lgr.Error("join_key_encode_err", "err", err, "rule_name", rule.name, "step", step.name, "evt_id", evtID)
+			continue
+		}
+
+		k := string(keyJSON)
+		if _, seen := keySteps[k]; !seen {
+			order = append(order, k)
+			keyVals[k] = key
+		}
+		keySteps[k] = append(keySteps[k], i)
+	}
+
+	for _, k := range order {
+		var chain []sequenceEntry
+		_, err := statestore.Update(s.state, "sequence:"+rule.name+":"+k, seq.window+windowStateSlack, func(old []byte) ([]byte, error) {
+			var st sequenceState
+			if old != nil {
+				err := json.Unmarshal(old, &st)
+				if err != nil {
+					lgr.Error("sequence_state_decode_err", "err", err, "rule_name", rule.name, "join_key", k)
+				}
+			}
+			if len(st.Steps) != len(seq.steps) {
+				st = sequenceState{Steps: make([][]sequenceEntry, len(seq.steps))}
+			}
+
+			for _, i := range keySteps[k] {
+				st.Steps[i] = addSequenceEntry(st.Steps[i], newEntry)
+			}
+			// drop records that are too old to be part of a sequence with rec
+			cutoff := evtTime.Add(-seq.window)
+			for i, entries := range st.Steps {
+				for len(entries) > 0 && entries[0].EventTime.Before(cutoff) {
+					entries = entries[1:]
+				}
+				st.Steps[i] = entries
+			}
+
+			chain = seq.findChain(st)
+			if chain != nil {
+				st = sequenceState{}
+			}
+
+			return json.Marshal(st)
+		})
+		if err != nil {
+			lgr.Error("sequence_state_store_err", "err", err, "rule_name", rule.name, "evt_id", evtID)
+			continue
+		}
+
+		lgr.Debug("sequence_advanced", "rule_name", rule.name, "evt_id", evtID, "join_key", k, "complete", chain != nil)
+		if chain == nil {
+			continue
+		}
+
+		var (
+			steps    = make([]interface{}, len(chain))
+			eventIDs = make([]interface{}, len(chain))
+		)
+		for i, e := range chain {
+			if e.Truncated && evtID != "" && e.EventID == evtID {
+				// the full record is still available for rec
+				e.Record = rec
+				e.Truncated = false
+			}
+			step := map[string]interface{}{
+				"step":       seq.steps[i].name,
+				"event_id":   e.EventID,
+				"event_time": e.EventTime.Format(time.RFC3339),
+				"record":     e.Record,
+			}
+			if e.Truncated {
+				step["record_truncated"] = true
+			}
+			steps[i] = step
+			eventIDs[i] = e.EventID
+		}
+		matchObjs = append(matchObjs, map[string]interface{}{
+			"join_key":  keyVals[k],
+			"event_ids": eventIDs,
+			"steps":     steps,
+		})
+	}
+
+	return matchObjs
+}
+
+// addSequenceEntry adds e to entries, keeping entries sorted by eventTime
+// and limited to the most recent maxSequenceCandidates.
+func addSequenceEntry(entries []sequenceEntry, e sequenceEntry) []sequenceEntry {
+	for _, existing := range entries {
+		if e.EventID != "" && existing.EventID == e.EventID {
+			// a record we've already seen (e.g. a retried delivery)
+			return entries
+		}
+	}
+
+	entries = append(entries, e)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].EventTime.Before(entries[j].EventTime)
+	})
+	if len(entries) > maxSequenceCandidates {
+		entries = entries[len(entries)-maxSequenceCandidates:]
+	}
+	return entries
+}
+
+// findChain returns one record for each step such that the records are in
+// eventTime order and span no more than the sequence's window. It returns
+// nil if there is no such chain.
+func (seq *sequence) findChain(st sequenceState) []sequenceEntry {
+	for _, first := range st.Steps[0] {
+		chain := []sequenceEntry{first}
+		used := map[string]bool{first.EventID: true}
+
+		for _, entries := range st.Steps[1:] {
+			prev := chain[len(chain)-1]
+			found := false
+			for _, e := range entries {
+				if e.EventTime.Before(prev.EventTime) || (e.EventID != "" && used[e.EventID]) {
+					continue
+				}
+				chain = append(chain, e)
+				used[e.EventID] = true
+				found = true
+				break
+			}
+			if !found {
+				break
+			}
+		}
+
+		if len(chain) == len(st.Steps) && chain[len(chain)-1].EventTime.Sub(first.EventTime) <= seq.window {
+			return chain
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/itchyny/gojq"
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/statestore"
+)
+
+const (
+	// windowStateSlack is how long threshold and sequence state is
+	// kept after its window ends. CloudTrail delivers records several
+	// minutes after they happen so the state has to outlive the window.
+	windowStateSlack = time.Hour
+
+	// maxThresholdSamples is the number of eventIDs included
+	// in a threshold alert.
+	maxThresholdSamples = 10
+
+	// maxThreshold bounds a threshold rule's threshold, since that
+	// many eventIDs and eventTimes are kept in each group's state.
+	maxThreshold = 1000
+)
+
+// threshold holds the settings for rules with type "threshold".
+type threshold struct {
+	groupBy *gojq.Code
+	count   int
+	window  time.Duration
+	// windowDesc is the window as written in the config
+	windowDesc string
+}
+
+func newThreshold(rule config.Rule) (*threshold, error) {
+	if rule.Threshold < 1 {
+		return nil, errors.New("threshold must be at least 1")
+	}
+	if rule.Threshold > maxThreshold {
+		return nil, fmt.Errorf("threshold must be at most %d", maxThreshold)
+	}
+	if rule.Window == "" {
+		return nil, errors.New("window must be set")
+	}
+	window, err := parseDuration(rule.Window)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window: %w", err)
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("window must be positive but was %q", rule.Window)
+	}
+
+	t := threshold{
+		count:      rule.Threshold,
+		window:     window,
+		windowDesc: rule.Window,
+	}
+
+	if rule.GroupBy != "" {
+		q, err := gojq.Parse(rule.GroupBy)
+		if err != nil {
+			return nil, fmt.Errorf("parse group_by err query=%q err=%w", rule.GroupBy, err)
+		}
+		t.groupBy, err = gojq.Compile(q, gojq.WithVariables([]string{"$match"}))
+		if err != nil {
+			return nil, fmt.Errorf("compile group_by err query=%q err=%w", rule.GroupBy, err)
+		}
+	}
+
+	return &t, nil
+}
+
+// thresholdState is the state kept for each group of a threshold rule.
+type thresholdState struct {
+	// Events are the most recent records counted for the group
+	// within the window, ordered by eventTime.
+	Events []thresholdEvent `json:"events"`
+	// Fired is the eventTime of the record that last fired an alert.
+	Fired time.Time `json:"fired"`
+}
+
+type thresholdEvent struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+// countThreshold counts rec towards its group of the threshold rule.
+// matches are the rule's match objects for rec; each record is counted
+// once regardless of how many match objects it has. If rec brings the
+// number of records in its group within any span of the rule's window
+// to the threshold, the match object for the alert is returned. A group
+// alerts at most once per window.
+//
+// Windows are based on the records' eventTime and slide: only the most
+// recent threshold records are kept, and records more than a window
+// older than the newest are dropped.
+func (s *server) countThreshold(lgr log15.Logger, rule *Rule, evtID string, rec map[string]interface{}, matches []interface{}) []interface{} {
+	t := rule.threshold
+
+	var group interface{}
+	if t.groupBy != nil {
+		iter := t.groupBy.Run(rec, matches[0])
+		v, ok := iter.Next()
+		if err, isErr := v.(error); isErr {
+			lgr.Error("group_by_err", "err", err, "rule_name", rule.name, "evt_id", evtID)
+			return nil
+		} else if ok {
+			group = v
+		}
+	}
+	groupJSON, err := json.Marshal(group)
+	if err != nil {
+		lgr.Error("group_by_encode_err", "err", err, "rule_name", rule.name, "evt_id", evtID)
+		return nil
+	}
+
+	var (
+		key     = "threshold:" + rule.name + ":" + string(groupJSON)
+		evtTime = eventTime(rec)
+		st      thresholdState
+		counted []thresholdEvent
+		fire    bool
+	)
+	_, err = statestore.Update(s.state, key, t.window+windowStateSlack, func(old []byte) ([]byte, error) {
+		st = thresholdState{}
+		if old != nil {
+			err := json.Unmarshal(old, &st)
+			if err != nil {
+				lgr.Error("threshold_state_decode_err", "err", err, "rule_name", rule.name, "key", key)
+				st = thresholdState{}
+			}
+		}
+
+		st.Events = addThresholdEvent(st.Events, thresholdEvent{ID: evtID, Time: evtTime}, t.count)
+		newest := st.Events[len(st.Events)-1].Time
+		cutoff := newest.Add(-t.window)
+		for len(st.Events) > 0 && st.Events[0].Time.Before(cutoff) {
+			st.Events = st.Events[1:]
+		}
+
+		counted = st.Events
+		fire = len(st.Events) >= t.count && (st.Fired.IsZero() || newest.Sub(st.Fired) >= t.window)
+		if fire {
+			// start counting again for the next alert
+			st.Fired = newest
+			st.Events = nil
+		}
+
+		return json.Marshal(st)
+	})
+	if err != nil {
+		lgr.Error("threshold_state_store_err", "err", err, "rule_name", rule.name, "evt_id", evtID)
+		return nil
+	}
+
+	lgr.Debug("threshold_counted", "rule_name", rule.name, "evt_id", evtID, "group", string(groupJSON), "count", len(counted))
+	if !fire {
+		return nil
+	}
+
+	var eventIDs []interface{}
+	for _, e := range counted {
+		if e.ID != "" && len(eventIDs) < maxThresholdSamples {
+			eventIDs = append(eventIDs, e.ID)
+		}
+	}
+
+	return []interface{}{
+		map[string]interface{}{
+			"group":        group,
+			"count":        len(counted),
+			"threshold":    t.count,
+			"window":       t.windowDesc,
+			"window_start": counted[0].Time.Format(time.RFC3339),
+			"event_ids":    eventIDs,
+			"match":        matches[0],
+		},
+	}
+}
+
+// addThresholdEvent adds e to events, keeping events sorted by eventTime
+// and limited to the most recent n.
+func addThresholdEvent(events []thresholdEvent, e thresholdEvent, n int) []thresholdEvent {
+	for _, existing := range events {
+		if e.ID != "" && existing.ID == e.ID {
+			// a record we've already counted (e.g. a retried delivery)
+			return events
+		}
+	}
+
+	events = append(events, e)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	if len(events) > n {
+		events = events[len(events)-n:]
+	}
+	return events
+}
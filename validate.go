@@ -0,0 +1,259 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/itchyny/gojq"
+	"github.com/psanford/cloudtrail-tattletail/config"
+	"github.com/psanford/cloudtrail-tattletail/internal/destination"
+	"github.com/psanford/cloudtrail-tattletail/internal/statestore"
+)
+
+type configProblem struct {
+	warning bool
+	msg     string
+}
+
+func (p configProblem) String() string {
+	if p.warning {
+		return "warning: " + p.msg
+	}
+	return "error: " + p.msg
+}
+
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	confPath := flags.String("config", "tattletail.toml", "Path to config file")
+	strict := flags.Bool("strict", false, "Treat warnings as errors")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s validate [-config tattletail.toml] [-strict]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Reports every problem found in the config file. Exits non-zero if there are errors.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	f, err := os.Open(*confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	s := newServer()
+	problems := s.validateConfig(f)
+
+	var failed bool
+	for _, p := range problems {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *confPath, p)
+		if !p.warning || *strict {
+			failed = true
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// validateConfig decodes the config from r and checks it for problems.
+// Unlike loadConfigFrom it does not stop at the first problem.
+func (s *server) validateConfig(r io.Reader) []configProblem {
+	var conf config.Config
+	md, err := toml.DecodeReader(r, &conf)
+	if err != nil {
+		return []configProblem{{msg: fmt.Sprintf("toml decode: %s", err)}}
+	}
+
+	var problems []configProblem
+	for _, key := range md.Undecoded() {
+		problems = append(problems, configProblem{
+			warning: true,
+			msg:     fmt.Sprintf("unknown config key %q", key.String()),
+		})
+	}
+
+	return append(problems, s.lintConfig(conf)...)
+}
+
+// lintConfig checks a decoded config for problems that would prevent it
+// from loading, as well as likely mistakes.
+func (s *server) lintConfig(conf config.Config) []configProblem {
+	var problems []configProblem
+	errorf := func(format string, args ...interface{}) {
+		problems = append(problems, configProblem{msg: fmt.Sprintf(format, args...)})
+	}
+	warnf := func(format string, args ...interface{}) {
+		problems = append(problems, configProblem{warning: true, msg: fmt.Sprintf(format, args...)})
+	}
+
+	if _, err := statestore.New(conf.StateStore); err != nil {
+		errorf("%s", err)
+	}
+
+	if conf.DedupTTL != "" {
+		if _, err := parseDuration(conf.DedupTTL); err != nil {
+			errorf("invalid dedup_ttl: %s", err)
+		}
+	}
+
+	for i, cs := range conf.Suppressions {
+		e, err := newException(cs.Exception)
+		if err != nil {
+			errorf("invalid suppression name=%q idx=%d: %s", cs.Name, i, err)
+		} else if e.expired(time.Now()) {
+			warnf("suppression name=%q idx=%d expired on %s", cs.Name, i, cs.Expires)
+		}
+	}
+
+	destUsed := make(map[string]bool)
+	for i, dest := range conf.Destinations {
+		if _, exists := destUsed[dest.ID]; exists {
+			errorf("duplicate destinations with same id: %q", dest.ID)
+		}
+		destUsed[dest.ID] = false
+
+		loader := s.loaders[dest.Type]
+		if loader == nil {
+			errorf("invalid destination type %q for destination id=%q idx=%d", dest.Type, dest.ID, i)
+			continue
+		}
+		_, err := loader.Load(dest)
+		if err != nil {
+			errorf("invalid destination config for id=%q idx=%d: %s", dest.ID, i, err)
+		}
+	}
+
+	nameCount := ruleNameCount(conf.Rules)
+	for i, rule := range conf.Rules {
+		if err := checkStateRuleName(conf, rule, nameCount); err != nil {
+			errorf("invalid rule name=%q idx=%d: %s", rule.Name, i, err)
+		}
+		if err := checkSharedState(conf, rule); err != nil {
+			warnf("rule name=%q idx=%d: %s", rule.Name, i, err)
+		}
+		if rule.Severity != "" && !destination.ValidSeverity(rule.Severity) {
+			errorf("invalid severity %q for rule name=%q idx=%d", rule.Severity, rule.Name, i)
+		}
+
+		switch rule.MatchMode {
+		case "", matchFirst, matchCollect, matchEach:
+		default:
+			errorf("invalid match_mode %q for rule name=%q idx=%d", rule.MatchMode, rule.Name, i)
+		}
+
+		switch rule.Type {
+		case "", ruleMatch:
+		case ruleThreshold:
+			if _, err := newThreshold(rule); err != nil {
+				errorf("invalid threshold rule name=%q idx=%d: %s", rule.Name, i, err)
+			}
+		case ruleFirstSeen:
+			if _, err := newFirstSeen(rule); err != nil {
+				errorf("invalid first_seen rule name=%q idx=%d: %s", rule.Name, i, err)
+			}
+		case ruleSequence:
+			if _, err := newSequence(rule); err != nil {
+				errorf("invalid sequence rule name=%q idx=%d: %s", rule.Name, i, err)
+			}
+		default:
+			errorf("invalid type %q for rule name=%q idx=%d", rule.Type, rule.Name, i)
+		}
+		if rule.Type != ruleThreshold && (rule.GroupBy != "" || rule.Threshold != 0) {
+			warnf("group_by and threshold are only used by threshold rules but are set for rule name=%q idx=%d", rule.Name, i)
+		}
+		if rule.Type != ruleThreshold && rule.Type != ruleSequence && rule.Window != "" {
+			warnf("window is only used by threshold and sequence rules but is set for rule name=%q idx=%d", rule.Name, i)
+		}
+		if rule.Type != ruleSequence && (len(rule.Steps) > 0 || rule.JoinKey != "") {
+			warnf("step and join_key are only used by sequence rules but are set for rule name=%q idx=%d", rule.Name, i)
+		}
+		if rule.Type != ruleFirstSeen && (rule.SeenKey != "" || rule.Retention != "" || rule.LearningPeriod != "") {
+			warnf("seen_key, retention and learning_period are only used by first_seen rules but are set for rule name=%q idx=%d", rule.Name, i)
+		}
+
+		if rule.JQMatch == "" && rule.Type != ruleSequence {
+			errorf("jq_match not defined for rule name=%q idx=%d", rule.Name, i)
+		} else if rule.JQMatch != "" {
+			if err := checkJQ(rule.JQMatch); err != nil {
+				errorf("jq_match err for rule name=%q idx=%d: %s", rule.Name, i, err)
+			}
+		}
+
+		if rule.JQTransform != "" {
+			if err := checkJQ(rule.JQTransform, "$match"); err != nil {
+				errorf("jq_transform err for rule name=%q idx=%d: %s", rule.Name, i, err)
+			}
+		}
+
+		if rule.DedupKey != "" {
+			if err := checkJQ(rule.DedupKey, "$match"); err != nil {
+				errorf("dedup_key err for rule name=%q idx=%d: %s", rule.Name, i, err)
+			}
+		}
+
+		if rule.DedupTTL != "" {
+			if _, err := parseDuration(rule.DedupTTL); err != nil {
+				errorf("invalid dedup_ttl for rule name=%q idx=%d: %s", rule.Name, i, err)
+			}
+		}
+
+		for j, ce := range rule.Exceptions {
+			e, err := newException(ce)
+			if err != nil {
+				errorf("invalid exception idx=%d for rule name=%q idx=%d: %s", j, rule.Name, i, err)
+			} else if e.expired(time.Now()) {
+				warnf("exception idx=%d for rule name=%q idx=%d expired on %s", j, rule.Name, i, ce.Expires)
+			}
+		}
+
+		if rule.Type == ruleSequence && len(rule.Tests) > 0 {
+			errorf("tests are not supported for sequence rules but are set for rule name=%q idx=%d", rule.Name, i)
+		}
+		for j, test := range rule.Tests {
+			if (test.Record == "") == (test.RecordFile == "") {
+				errorf("exactly one of record or record_file must be set for test idx=%d of rule name=%q idx=%d", j, rule.Name, i)
+			}
+		}
+
+		if len(rule.Destinations) == 0 {
+			warnf("no destinations for rule name=%q idx=%d", rule.Name, i)
+		}
+		for _, destName := range rule.Destinations {
+			if _, exists := destUsed[destName]; !exists {
+				errorf("unknown destination %q for rule name=%q idx=%d", destName, rule.Name, i)
+				continue
+			}
+			destUsed[destName] = true
+		}
+	}
+
+	for _, dest := range conf.Destinations {
+		if !destUsed[dest.ID] {
+			warnf("destination id=%q is not used by any rule", dest.ID)
+			// only warn once for duplicate ids
+			destUsed[dest.ID] = true
+		}
+	}
+
+	return problems
+}
+
+// checkJQ parses and compiles query to catch errors such as undefined
+// functions that are not reported by gojq.Parse.
+func checkJQ(query string, variables ...string) error {
+	q, err := gojq.Parse(query)
+	if err != nil {
+		return fmt.Errorf("parse err: %w", err)
+	}
+	_, err = gojq.Compile(q, gojq.WithVariables(variables))
+	if err != nil {
+		return fmt.Errorf("compile err: %w", err)
+	}
+	return nil
+}